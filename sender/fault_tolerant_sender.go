@@ -3,6 +3,8 @@ package sender
 import (
 	"bytes"
 	"encoding/json"
+	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -18,6 +20,14 @@ const (
 	maxBytesPerFile   = 100 * mb
 	qNameSuffix       = "_local_save"
 	defaultMaxProcs   = 1 // 默认没有并发
+	defaultMinProcs   = 1 // 默认最小并发数
+
+	// shardEvalInterval 每隔多久重新评估一次期望的发送并发数(shard数)
+	shardEvalInterval = 10 * time.Second
+	// shardEwmaDecay samplesIn/samplesOut 等采样值的 ewma 衰减系数
+	shardEwmaDecay = 0.2
+	// shardStableTicks desiredShards 连续多少次评估结果一致才会真正触发扩缩容，避免抖动
+	shardStableTicks = 2
 )
 
 // 可选参数 fault_tolerant 为true的话，以下必填
@@ -26,7 +36,9 @@ const (
 	KeyFtSaveLogPath = "ft_save_log_path" // disk queue 数据日志路径
 	KeyFtWriteLimit  = "ft_write_limit"   // 写入速度限制，单位MB
 	KeyFtStrategy    = "ft_strategy"      // ft 的策略
-	KeyFtProcs       = "ft_procs"         // ft并发数，当always_save 策略时启用
+	KeyFtProcs       = "ft_procs"         // ft并发数，当always_save 策略时启用，同时作为自动扩缩容的初始并发数
+	KeyFtMinProcs    = "ft_min_procs"     // ft 自动扩缩容的最小并发数
+	KeyFtMaxProcs    = "ft_max_procs"     // ft 自动扩缩容的最大并发数
 )
 
 // ft 策略
@@ -44,16 +56,141 @@ type FtSender struct {
 	innerSender Sender
 	logQueue    queue.BackendQueue
 	backupQueue queue.BackendQueue
-	writeLimit  int  // 写入速度限制，单位MB
-	backupOnly  bool // 是否只使用backup queue
-	procs       int  //发送并发数
+	writeLimit  int          // 写入速度限制，单位MB
+	backupOnly  bool         // 是否只使用backup queue
+	codec       PayloadCodec // disk queue 里每条 payload 的编解码方式
 	se          *utils.StatsError
+
+	minProcs int32 // 自动扩缩容允许的最小并发数
+	maxProcs int32 // 自动扩缩容允许的最大并发数
+	curProcs int32 // 当前实际运行的 sendFromStreamQueue 并发数，原子操作
+
+	shardWg     sync.WaitGroup  // 等待所有 sendFromStreamQueue goroutine 退出，支持动态增删
+	shardMu     sync.Mutex      // 保护 shardQuits 以及下面的扩缩容评估状态
+	shardQuits  []chan struct{} // 每个 sendFromStreamQueue goroutine 对应的优雅退出通知
+	reshardChan chan int32      // manageShards 监听的目标并发数
+	lastDesired int32           // 上一次评估出的期望并发数
+	stableTicks int             // desiredShards 连续保持不变的评估次数
+
+	samplesIn    int64 // Send 累计接收到的记录数，原子计数
+	samplesOut   int64 // sendFromStreamQueue 累计成功发送的记录数，原子计数
+	samplesOutNs int64 // sendFromStreamQueue 累计成功发送所消耗的时间，单位纳秒，原子计数
+
+	inRateEwma  *ewma // samplesIn 速率(records/s)的 ewma，仅由 evalShards goroutine 更新，更新和 ShardStats 读取时都持有 shardMu
+	outRateEwma *ewma // samplesOut 吞吐(records/s)的 ewma，仅由 evalShards goroutine 更新，更新和 ShardStats 读取时都持有 shardMu
+
+	maxRetries     int        // 一条数据最多重试多少次，超过后进 dead letter
+	deadLetterPath string     // dead letter 落盘目录，空表示只丢弃不落盘
+	deadLetterMu   sync.Mutex // 保护 dead letter 文件的读写/滚动
+	deadLetters    int64      // 累计被放弃的批次数，原子计数
+
+	saveLogPath    string        // disk queue 所在目录，ft_storage_mode=disk 时 pollDiskUsage 轮询这个目录
+	diskUsageDirs  []string      // pollDiskUsage 实际统计磁盘占用的目录列表：disk 模式下只有 saveLogPath，rs 模式下是各分片的 ft_rs_paths 子目录
+	maxDiskUsage   int64         // ft_max_disk_usage_mb 对应的字节数，<=0 表示不限制
+	overflowPolicy string        // ft_overflow_policy
+	blockTimeout   time.Duration // ft_overflow_policy=block 时最多阻塞多久
+	diskUsageBytes int64         // pollDiskUsage 统计出的当前磁盘用量，原子读写
+	droppedOldest  int64         // drop_oldest 策略丢弃的批次数，原子计数
+	droppedNewest  int64         // drop_newest 策略拒绝的批次数，原子计数
+
+	// 下面这组字段实现 Send 前面的合并缓冲：always_save 策略下，Send 不再每次都落盘，
+	// 而是先攒到内存缓冲区，等命中 ft_batch_max_records/ft_batch_max_bytes/ft_batch_max_latency_ms
+	// 任意一个阈值再整体落盘一次，用来减少高频小批量写入时 disk queue 的 Put 次数和 fsync 频率。
+	// 注意这段缓冲区只在内存里，进程崩溃会丢失还没落盘的数据，可以用 Flush() 在关键检查点兜底
+	batchMaxRecords int            // ft_batch_max_records，<=0 表示不按条数触发
+	batchMaxBytes   int            // ft_batch_max_bytes，<=0 表示不按字节数触发
+	batchMaxLatency time.Duration  // ft_batch_max_latency_ms，<=0 表示不按等待时间触发
+	batchMu         sync.Mutex     // 保护下面三个字段
+	batchDatas      []Data         // 还没落盘的缓冲数据
+	batchBytes      int            // batchDatas 的近似序列化字节数
+	batchOldest     time.Time      // batchDatas 里最早一条数据进来的时间，用来判断是否等太久了
+	batchRetryAt    time.Time      // 上一次 flush 失败后，下次允许重试的时间；零值表示没有待重试的失败批次
+	flushSignal     chan struct{}  // 唤醒 batchFlusher 立刻做一次 flush
+	batchWg         sync.WaitGroup // 等待 batchFlusher goroutine 退出，避免 Close 在它还在 flushBatch 时就把 logQueue/backupQueue 关掉
 }
 
 type datasContext struct {
 	Datas []Data `json:"datas"`
 }
 
+// ewma 是一个简单的指数加权移动平均实现，用于平滑 samplesIn/samplesOut 这类瞬时采样值
+type ewma struct {
+	decay    float64
+	value    float64
+	hasValue bool
+}
+
+func newEWMA(decay float64) *ewma {
+	return &ewma{decay: decay}
+}
+
+// Update 将新的采样值计入 ewma，第一次调用直接取值作为初始值
+func (e *ewma) Update(sample float64) {
+	if !e.hasValue {
+		e.value = sample
+		e.hasValue = true
+		return
+	}
+	e.value = e.decay*sample + (1-e.decay)*e.value
+}
+
+func (e *ewma) Value() float64 {
+	return e.value
+}
+
+// ShardStats 对外暴露 ft 自动扩缩容的当前状态，供监控/UI 展示
+type ShardStats struct {
+	CurProcs int32   `json:"cur_procs"`
+	MinProcs int32   `json:"min_procs"`
+	MaxProcs int32   `json:"max_procs"`
+	InRate   float64 `json:"in_rate"`  // samplesIn 的 ewma 速率，单位 records/s
+	OutRate  float64 `json:"out_rate"` // samplesOut 的 ewma 吞吐，单位 records/s
+}
+
+// ShardStats 返回当前自动扩缩容状态。
+//
+// 这组状态理想情况下应该挂在 Send 已经返回的 utils.StatsError 上，这样监控/UI 不用额外拿一次
+// FtSender 的引用。但 utils.StatsError 是 github.com/qiniu/logkit/utils 包里的外部类型，
+// 这个代码快照里根本没有 utils 包的源码(没有 go.mod/vendor，utils/queue/conf 都是外部依赖)，
+// 没法往它上面加字段，所以只能退而求其次，用这个独立方法暴露同样的信息
+func (ft *FtSender) ShardStats() ShardStats {
+	ft.shardMu.Lock()
+	defer ft.shardMu.Unlock()
+	return ShardStats{
+		CurProcs: atomic.LoadInt32(&ft.curProcs),
+		MinProcs: ft.minProcs,
+		MaxProcs: ft.maxProcs,
+		InRate:   ft.inRateEwma.Value(),
+		OutRate:  ft.outRateEwma.Value(),
+	}
+}
+
+// ftSenderConfig 收拢 FtSender 的全部构造参数，避免 newFtSender 的参数列表随着
+// ft_* 配置项的增加而无限变长
+type ftSenderConfig struct {
+	saveLogPath    string
+	syncEvery      int64
+	writeLimit     int
+	backupOnly     bool
+	procs          int
+	minProcs       int
+	maxProcs       int
+	codecName      string
+	maxRetries     int
+	deadLetterPath string
+	maxDiskUsageMB int
+	overflowPolicy string
+	blockTimeoutS  int
+	storageMode    string
+	rsDataShards   int
+	rsParityShards int
+	rsPaths        []string
+
+	batchMaxRecords   int
+	batchMaxBytes     int
+	batchMaxLatencyMs int
+}
+
 // NewFtSender Fault tolerant sender constructor
 func NewFtSender(sender Sender, conf conf.MapConf) (*FtSender, error) {
 	logpath, err := conf.GetString(KeyFtSaveLogPath)
@@ -64,28 +201,138 @@ func NewFtSender(sender Sender, conf conf.MapConf) (*FtSender, error) {
 	writeLimit, _ := conf.GetIntOr(KeyFtWriteLimit, defaultWriteLimit)
 	strategy, _ := conf.GetStringOr(KeyFtStrategy, KeyFtStrategyAlwaysSave)
 	procs, _ := conf.GetIntOr(KeyFtProcs, defaultMaxProcs)
-	return newFtSender(sender, logpath, int64(syncEvery), writeLimit, strategy == KeyFtStrategyBackupOnly, procs)
+	minProcs, _ := conf.GetIntOr(KeyFtMinProcs, defaultMinProcs)
+	maxProcs, _ := conf.GetIntOr(KeyFtMaxProcs, procs)
+	codecName, _ := conf.GetStringOr(KeyFtPayloadCodec, CodecJSON)
+	maxRetries, _ := conf.GetIntOr(KeyFtMaxRetries, defaultMaxRetries)
+	deadLetterPath, _ := conf.GetStringOr(KeyFtDeadLetterPath, "")
+	maxDiskUsageMB, _ := conf.GetIntOr(KeyFtMaxDiskUsageMB, 0)
+	overflowPolicy, _ := conf.GetStringOr(KeyFtOverflowPolicy, defaultOverflowPolicy)
+	blockTimeoutS, _ := conf.GetIntOr(KeyFtBlockTimeout, defaultBlockTimeoutSec)
+	storageMode, _ := conf.GetStringOr(KeyFtStorageMode, StorageModeDisk)
+	rsDataShards, _ := conf.GetIntOr(KeyFtRsDataShards, defaultRsDataShards)
+	rsParityShards, _ := conf.GetIntOr(KeyFtRsParityShards, defaultRsParityShards)
+	rsPaths, _ := conf.GetStringOr(KeyFtRsPaths, "")
+	batchMaxRecords, _ := conf.GetIntOr(KeyFtBatchMaxRecords, 0)
+	batchMaxBytes, _ := conf.GetIntOr(KeyFtBatchMaxBytes, 0)
+	batchMaxLatencyMs, _ := conf.GetIntOr(KeyFtBatchMaxLatencyMs, 0)
+	return newFtSender(sender, ftSenderConfig{
+		saveLogPath:    logpath,
+		syncEvery:      int64(syncEvery),
+		writeLimit:     writeLimit,
+		backupOnly:     strategy == KeyFtStrategyBackupOnly,
+		procs:          procs,
+		minProcs:       minProcs,
+		maxProcs:       maxProcs,
+		codecName:      codecName,
+		maxRetries:     maxRetries,
+		deadLetterPath: deadLetterPath,
+		maxDiskUsageMB: maxDiskUsageMB,
+		overflowPolicy: overflowPolicy,
+		blockTimeoutS:  blockTimeoutS,
+		storageMode:    storageMode,
+		rsDataShards:   rsDataShards,
+		rsParityShards: rsParityShards,
+		rsPaths:        splitRsPaths(rsPaths),
+
+		batchMaxRecords:   batchMaxRecords,
+		batchMaxBytes:     batchMaxBytes,
+		batchMaxLatencyMs: batchMaxLatencyMs,
+	})
 }
 
-func newFtSender(innerSender Sender, saveLogPath string, syncEvery int64, writeLimit int, backupOnly bool, procs int) (*FtSender, error) {
-	err := utils.CreateDirIfNotExist(saveLogPath)
+func newFtSender(innerSender Sender, c ftSenderConfig) (*FtSender, error) {
+	err := utils.CreateDirIfNotExist(c.saveLogPath)
 	if err != nil {
 		return nil, err
 	}
+	if c.deadLetterPath != "" {
+		if err := utils.CreateDirIfNotExist(c.deadLetterPath); err != nil {
+			return nil, err
+		}
+	}
+	if c.maxProcs < c.minProcs {
+		c.maxProcs = c.minProcs
+	}
+	if c.procs < c.minProcs {
+		c.procs = c.minProcs
+	}
+	if c.procs > c.maxProcs {
+		c.procs = c.maxProcs
+	}
+	codec, ok := payloadCodecs[c.codecName]
+	if !ok {
+		log.Warnf("ft_payload_codec %q is not recognized, fallback to %q", c.codecName, CodecJSON)
+		codec = payloadCodecs[CodecJSON]
+	}
+	maxRetries := c.maxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+	overflowPolicy := c.overflowPolicy
+	switch overflowPolicy {
+	case OverflowPolicyBlock, OverflowPolicyDropOldest, OverflowPolicyDropNewest, OverflowPolicyError:
+	default:
+		log.Warnf("ft_overflow_policy %q is not recognized, fallback to %q", overflowPolicy, defaultOverflowPolicy)
+		overflowPolicy = defaultOverflowPolicy
+	}
+	blockTimeoutS := c.blockTimeoutS
+	if blockTimeoutS <= 0 {
+		blockTimeoutS = defaultBlockTimeoutSec
+	}
 
-	lq := queue.NewDiskQueue("stream"+qNameSuffix, saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, syncEvery, syncEvery, time.Second*2, writeLimit*mb)
-	bq := queue.NewDiskQueue("backup"+qNameSuffix, saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, syncEvery, syncEvery, time.Second*2, writeLimit*mb)
+	var lq, bq queue.BackendQueue
+	var diskUsageDirs []string
+	if c.storageMode == StorageModeRS {
+		streamDirs := rsShardDirs(c.rsPaths, "stream"+qNameSuffix)
+		backupDirs := rsShardDirs(c.rsPaths, "backup"+qNameSuffix)
+		lq, err = newRSQueue("stream"+qNameSuffix, streamDirs, c.rsDataShards, c.rsParityShards, maxBytesPerFile, c.syncEvery, c.writeLimit)
+		if err != nil {
+			return nil, err
+		}
+		bq, err = newRSQueue("backup"+qNameSuffix, backupDirs, c.rsDataShards, c.rsParityShards, maxBytesPerFile, c.syncEvery, c.writeLimit)
+		if err != nil {
+			return nil, err
+		}
+		// rs 模式下数据并不落在 saveLogPath 下面，而是分散到各自独立的 ft_rs_paths 磁盘里，
+		// 所以 pollDiskUsage 得把这些分片目录都加起来，否则 ft_max_disk_usage_mb 永远不会生效
+		diskUsageDirs = append(append([]string{}, streamDirs...), backupDirs...)
+	} else {
+		lq = queue.NewDiskQueue("stream"+qNameSuffix, c.saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, c.syncEvery, c.syncEvery, time.Second*2, c.writeLimit*mb)
+		bq = queue.NewDiskQueue("backup"+qNameSuffix, c.saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, c.syncEvery, c.syncEvery, time.Second*2, c.writeLimit*mb)
+		diskUsageDirs = []string{c.saveLogPath}
+	}
 	ftSender := FtSender{
-		exitChan:    make(chan struct{}),
-		innerSender: innerSender,
-		logQueue:    lq,
-		backupQueue: bq,
-		writeLimit:  writeLimit,
-		backupOnly:  backupOnly,
-		procs:       procs,
-		se:          &utils.StatsError{Ft: true},
-	}
-	go ftSender.asyncSendLogFromDiskQueue()
+		exitChan:       make(chan struct{}),
+		innerSender:    innerSender,
+		logQueue:       lq,
+		backupQueue:    bq,
+		writeLimit:     c.writeLimit,
+		backupOnly:     c.backupOnly,
+		codec:          codec,
+		minProcs:       int32(c.minProcs),
+		maxProcs:       int32(c.maxProcs),
+		reshardChan:    make(chan int32, 1),
+		inRateEwma:     newEWMA(shardEwmaDecay),
+		outRateEwma:    newEWMA(shardEwmaDecay),
+		maxRetries:     maxRetries,
+		deadLetterPath: c.deadLetterPath,
+		saveLogPath:    c.saveLogPath,
+		diskUsageDirs:  diskUsageDirs,
+		maxDiskUsage:   int64(c.maxDiskUsageMB) * mb,
+		overflowPolicy: overflowPolicy,
+		blockTimeout:   time.Duration(blockTimeoutS) * time.Second,
+		se:             &utils.StatsError{Ft: true},
+
+		batchMaxRecords: c.batchMaxRecords,
+		batchMaxBytes:   c.batchMaxBytes,
+		batchMaxLatency: time.Duration(c.batchMaxLatencyMs) * time.Millisecond,
+		flushSignal:     make(chan struct{}, 1),
+	}
+	go ftSender.asyncSendLogFromDiskQueue(c.procs)
+	go ftSender.pollDiskUsage()
+	ftSender.batchWg.Add(1)
+	go ftSender.batchFlusher()
 	return &ftSender, nil
 }
 
@@ -94,6 +341,7 @@ func (ft *FtSender) Name() string {
 }
 
 func (ft *FtSender) Send(datas []Data) error {
+	atomic.AddInt64(&ft.samplesIn, int64(len(datas)))
 	if ft.backupOnly {
 		// 尝试直接发送数据，当数据失败的时候会加入到本地重试队列。外部不需要重试
 		err := ft.trySendDatas(datas, 1)
@@ -106,6 +354,12 @@ func (ft *FtSender) Send(datas []Data) error {
 		// 容错队列会保证重试，此处不向外部暴露发送错误信息
 		ft.se.ErrorDetail = nil
 		ft.se.Ftlag = ft.backupQueue.Depth()
+	} else if ft.batchingEnabled() {
+		// 合并缓冲开启时，这里只是把数据攒进内存缓冲区，真正的落盘由 batchFlusher 异步完成，
+		// 因此这里看不到 saveToFile 可能返回的错误；调用方如果需要落盘错误，应该调小阈值或用 Flush()
+		ft.appendBatch(datas)
+		ft.se.Ftlag = ft.backupQueue.Depth() + ft.logQueue.Depth()
+		ft.se.ErrorDetail = nil
 	} else {
 		err := ft.saveToFile(datas)
 		if err != nil {
@@ -122,10 +376,12 @@ func (ft *FtSender) Close() error {
 	log.Warn("wait for sender " + ft.Name() + " completely exit")
 	// 等待错误恢复流程退出
 	<-ft.exitChan
-	// 等待正常发送流程退出
-	for i := 0; i < ft.procs; i++ {
-		<-ft.exitChan
-	}
+	// 等待所有发送 goroutine 退出，数量会随自动扩缩容变化，因此用 WaitGroup 而非固定次数
+	ft.shardWg.Wait()
+	// batchFlusher 发现 stopped 之后会自己做最后一次 flush 再退出；这里等它真正退出之后才能关
+	// 下面的 logQueue/backupQueue，否则 batchFlusher 可能还在 flushBatch -> saveToFile ->
+	// logQueue.Put 的路上，和 Close 关 queue 形成竞态
+	ft.batchWg.Wait()
 
 	log.Warn(ft.Name() + " has been completely exited")
 
@@ -136,19 +392,25 @@ func (ft *FtSender) Close() error {
 	return ft.innerSender.Close()
 }
 
-// marshalData 将数据序列化
+// marshalData 将数据用 ft.codec 序列化，并在最前面加一个 header 字节记录用的是哪种 codec，
+// 这样 unmarshalData/decodePayload 读回来的时候才知道该用哪种 codec 解码
 func (ft *FtSender) marshalData(datas []Data) (bs []byte, err error) {
-	ctx := new(datasContext)
-	ctx.Datas = datas
-	bs, err = json.Marshal(ctx)
+	payload, err := ft.codec.Marshal(datas)
 	if err != nil {
-		err = NewSendError("Cannot marshal data :"+err.Error(), datas, TypeDefault)
-		return
+		return nil, err
 	}
-	return
+	header, ok := codecHeaderByName[ft.codec.Name()]
+	if !ok {
+		header = codecHeaderJSON
+	}
+	bs = make([]byte, 0, len(payload)+1)
+	bs = append(bs, header)
+	bs = append(bs, payload...)
+	return bs, nil
 }
 
-// unmarshalData 如何将数据从磁盘中反序列化出来
+// unmarshalData 按照升级前的格式(没有 codec header，整段数据就是 json)解析，
+// 仅用于兼容老 spool 里遗留下来的数据，新写入的数据走 decodePayload
 func (ft *FtSender) unmarshalData(dat []byte) (datas []Data, err error) {
 	ctx := new(datasContext)
 	d := json.NewDecoder(bytes.NewReader(dat))
@@ -161,7 +423,23 @@ func (ft *FtSender) unmarshalData(dat []byte) (datas []Data, err error) {
 	return
 }
 
+// decodePayload 读取 dat 最前面的 codec header 字节并用对应的 PayloadCodec 解码；
+// 如果第一个字节不是一个认识的 header，说明这是升级前写入的、没有 header 的历史 json payload，
+// 原样走 unmarshalData 兼容解析，保证升级不会丢数据
+func (ft *FtSender) decodePayload(dat []byte) ([]Data, error) {
+	if len(dat) == 0 {
+		return nil, nil
+	}
+	if codec, ok := codecByHeader(dat[0]); ok {
+		return codec.Unmarshal(dat[1:])
+	}
+	return ft.unmarshalData(dat)
+}
+
 func (ft *FtSender) saveToFile(datas []Data) error {
+	if allow, err := ft.checkDiskQuota(); !allow {
+		return err
+	}
 	bs, err := ft.marshalData(datas)
 	if err != nil {
 		return err
@@ -173,75 +451,278 @@ func (ft *FtSender) saveToFile(datas []Data) error {
 	return nil
 }
 
-func (ft *FtSender) asyncSendLogFromDiskQueue() {
-	for i := 0; i < ft.procs; i++ {
-		go ft.sendFromStreamQueue()
-	}
+// asyncSendLogFromDiskQueue 启动初始并发的发送 goroutine，以及重试、扩缩容相关的后台 goroutine
+func (ft *FtSender) asyncSendLogFromDiskQueue(procs int) {
+	ft.addShards(procs)
 	go ft.retryFromBackupQueue()
+	go ft.manageShards()
+	go ft.evalShards()
 }
 
-// trySend 从bytes反序列化数据后尝试发送数据
-func (ft *FtSender) trySendBytes(dat []byte, failSleep int) (err error) {
-	datas, err := ft.unmarshalData(dat)
-	if err != nil {
-		return
+// addShards 启动 n 个新的 sendFromStreamQueue goroutine，用于扩容
+func (ft *FtSender) addShards(n int) {
+	for i := 0; i < n; i++ {
+		quit := make(chan struct{})
+		ft.shardMu.Lock()
+		ft.shardQuits = append(ft.shardQuits, quit)
+		ft.shardMu.Unlock()
+		ft.shardWg.Add(1)
+		atomic.AddInt32(&ft.curProcs, 1)
+		go ft.sendFromStreamQueue(quit)
 	}
-	return ft.trySendDatas(datas, failSleep)
 }
 
-// trySendDatas 尝试发送数据，如果失败，将失败数据加入backup queue，并睡眠指定时间。返回结果为是否正常发送
-func (ft *FtSender) trySendDatas(datas []Data, failSleep int) (err error) {
-	err = ft.innerSender.Send(datas)
-	if c, ok := err.(*utils.StatsError); ok {
-		err = c.ErrorDetail
+// removeShards 优雅地缩容 n 个 goroutine：关闭对应的 quit channel，
+// 目标 goroutine 会在处理完当前读到的数据后退出，不会丢失正在处理的数据
+func (ft *FtSender) removeShards(n int) {
+	ft.shardMu.Lock()
+	if n > len(ft.shardQuits) {
+		n = len(ft.shardQuits)
 	}
-	if err != nil {
-		log.Errorf("%s cannot write points + %v", ft.innerSender.Name(), err)
-		failCtx := new(datasContext)
-		var binaryUnpack bool
-		se, succ := err.(*SendError)
-		if !succ {
-			// 如果不是SendError 默认所有的数据都发送失败
-			log.Infof("error type is not *SendError! reSend all datas by default")
-			failCtx.Datas = datas
-		} else {
-			failCtx.Datas = se.failDatas
-			if se.ErrorType == TypeBinaryUnpack {
-				binaryUnpack = true
+	victims := ft.shardQuits[:n]
+	ft.shardQuits = ft.shardQuits[n:]
+	ft.shardMu.Unlock()
+	for _, q := range victims {
+		close(q)
+	}
+}
+
+// manageShards 监听 reshardChan，对 sendFromStreamQueue 的并发数进行扩容或缩容
+func (ft *FtSender) manageShards() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case desired := <-ft.reshardChan:
+			if atomic.LoadInt32(&ft.stopped) > 0 {
+				// Close 已经在等 shardWg 了，这里如果还按 desired 扩容会在 shardWg.Add 和
+				// Close 的 shardWg.Wait 之间产生竞态(甚至 panic)，并且新 goroutine 也不会被
+				// Close 等到；既然已经要退出了，这次调整就直接丢弃
+				return
+			}
+			cur := atomic.LoadInt32(&ft.curProcs)
+			if desired > cur {
+				log.Infof("%s scaling up ft shards from %d to %d", ft.innerSender.Name(), cur, desired)
+				ft.addShards(int(desired - cur))
+			} else if desired < cur {
+				log.Infof("%s scaling down ft shards from %d to %d", ft.innerSender.Name(), cur, desired)
+				ft.removeShards(int(cur - desired))
+			}
+		case <-ticker.C:
+			if atomic.LoadInt32(&ft.stopped) > 0 {
+				return
 			}
 		}
-		if binaryUnpack {
-			lens := len(failCtx.Datas) / 2
-			if lens > 0 {
-				newFailCtx := new(datasContext)
-				newFailCtx.Datas = failCtx.Datas[0:lens]
-				failCtx.Datas = failCtx.Datas[lens:]
-				nnBytes, _ := json.Marshal(newFailCtx)
-				ft.backupQueue.Put(nnBytes)
+	}
+}
+
+// evalShards 每隔 shardEvalInterval 根据 samplesIn/samplesOut 的 ewma 估算所需并发数，
+// desiredShards = ceil(samplesInRate / samplesOutRate)，连续 shardStableTicks 次评估结果一致才会真正生效，避免抖动
+func (ft *FtSender) evalShards() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastIn, lastOut, lastOutNs int64
+	ticks := 0
+	for range ticker.C {
+		if atomic.LoadInt32(&ft.stopped) > 0 {
+			return
+		}
+		ticks++
+		if time.Duration(ticks)*time.Second < shardEvalInterval {
+			continue
+		}
+		ticks = 0
+
+		in := atomic.LoadInt64(&ft.samplesIn)
+		out := atomic.LoadInt64(&ft.samplesOut)
+		outNs := atomic.LoadInt64(&ft.samplesOutNs)
+		deltaIn, deltaOut, deltaOutNs := in-lastIn, out-lastOut, outNs-lastOutNs
+		lastIn, lastOut, lastOutNs = in, out, outNs
+
+		ft.shardMu.Lock()
+		ft.inRateEwma.Update(float64(deltaIn) / shardEvalInterval.Seconds())
+		if deltaOutNs > 0 {
+			ft.outRateEwma.Update(float64(deltaOut) / (float64(deltaOutNs) / float64(time.Second)))
+		}
+		ft.shardMu.Unlock()
+
+		samplesOutRate := ft.outRateEwma.Value()
+		if samplesOutRate <= 0 {
+			continue
+		}
+		desired := int32(math.Ceil(ft.inRateEwma.Value() / samplesOutRate))
+		if desired < ft.minProcs {
+			desired = ft.minProcs
+		}
+		if desired > ft.maxProcs {
+			desired = ft.maxProcs
+		}
+
+		ft.shardMu.Lock()
+		cur := atomic.LoadInt32(&ft.curProcs)
+		if desired == cur {
+			ft.stableTicks = 0
+			ft.shardMu.Unlock()
+			continue
+		}
+		if desired == ft.lastDesired {
+			ft.stableTicks++
+		} else {
+			ft.lastDesired = desired
+			ft.stableTicks = 1
+		}
+		trigger := ft.stableTicks >= shardStableTicks
+		if trigger {
+			ft.stableTicks = 0
+		}
+		ft.shardMu.Unlock()
+
+		if trigger && atomic.LoadInt32(&ft.stopped) == 0 {
+			select {
+			case ft.reshardChan <- desired:
+			default:
+				// manageShards 还没消费上一次的调整，跳过这次，下次评估会再次尝试
 			}
 		}
-		newBytes, _ := json.Marshal(failCtx)
-		ft.backupQueue.Put(newBytes)
+	}
+}
+
+// attemptSend 调用内层 sender 发送数据，返回发送失败的那部分数据(如果不是 *SendError，默认全部失败)
+// 以及这次失败是否属于 TypeBinaryUnpack
+func (ft *FtSender) attemptSend(datas []Data) (failDatas []Data, binaryUnpack bool, err error) {
+	err = ft.innerSender.Send(datas)
+	if c, ok := err.(*utils.StatsError); ok {
+		err = c.ErrorDetail
+	}
+	if err == nil {
+		return nil, false, nil
+	}
+	log.Errorf("%s cannot write points + %v", ft.innerSender.Name(), err)
+	se, succ := err.(*SendError)
+	if !succ {
+		// 如果不是SendError 默认所有的数据都发送失败
+		log.Infof("error type is not *SendError! reSend all datas by default")
+		return datas, false, err
+	}
+	return se.failDatas, se.ErrorType == TypeBinaryUnpack, err
+}
+
+// enqueueRetry 把一批发送失败的数据重新放回 backup queue 等待重试，并记录重试次数/首次失败时间/最近一次错误。
+// TypeBinaryUnpack 的失败会把批次二分成两半，分别作为普通的重试记录放回 backup queue；重试时再次以
+// TypeBinaryUnpack 失败会继续二分，直到子批次只剩一条；只剩一条仍然失败的数据被认为是 poison message，
+// 不再进入正常的重试流程，直接写入 dead letter
+func (ft *FtSender) enqueueRetry(datas []Data, binaryUnpack bool, sendErr error, retries int, firstFailedAt time.Time) {
+	if len(datas) == 0 {
+		return
+	}
+	if firstFailedAt.IsZero() {
+		firstFailedAt = time.Now()
+	}
+	if binaryUnpack && len(datas) > 1 {
+		mid := len(datas) / 2
+		ft.enqueueRetry(datas[:mid], false, sendErr, retries, firstFailedAt)
+		ft.enqueueRetry(datas[mid:], false, sendErr, retries, firstFailedAt)
+		return
+	}
+
+	lastErr := ""
+	if sendErr != nil {
+		lastErr = sendErr.Error()
+	}
+	retries++
+	poison := binaryUnpack && len(datas) == 1
+	env := &ftRetryEnvelope{
+		ftEnvelopeMeta: ftEnvelopeMeta{
+			Retries:       retries,
+			FirstFailedAt: firstFailedAt,
+			LastErr:       lastErr,
+			Poison:        poison,
+		},
+		Datas: datas,
+	}
+	if poison || retries > ft.maxRetries {
+		ft.writeDeadLetter(env)
+		return
+	}
+	if allow, err := ft.checkDiskQuota(); !allow {
+		log.Errorf("%s cannot put retry envelope into backup queue, disk quota exceeded: %v", ft.innerSender.Name(), err)
+		return
+	}
+	bs, err := ft.encodeEnvelope(env)
+	if err != nil {
+		log.Errorf("%s cannot encode retry envelope: %v", ft.innerSender.Name(), err)
+		return
+	}
+	ft.backupQueue.Put(bs)
+}
+
+// trySendBytes 从 logQueue 里取出一条还没有重试信息的原始批次，尝试发送，返回值 n 为这批数据的记录数
+// (err 为 nil 时即成功发送的记录数；发送失败时 n 同样是整批的记录数)。
+// 发送失败时作为第一次重试记录写入 backup queue
+func (ft *FtSender) trySendBytes(dat []byte, failSleep int) (n int, err error) {
+	datas, err := ft.decodePayload(dat)
+	if err != nil {
+		return
+	}
+	n = len(datas)
+	failDatas, binaryUnpack, err := ft.attemptSend(datas)
+	if err != nil {
+		ft.enqueueRetry(failDatas, binaryUnpack, err, 0, time.Time{})
 		time.Sleep(time.Second * time.Duration(failSleep))
 	}
 	return
 }
 
-func (ft *FtSender) sendFromStreamQueue() {
+// trySendDatas 尝试直接发送数据，失败时作为第一次重试记录写入 backup queue；
+// 仅供 Send 在 backup_only 策略下的首次发送使用
+func (ft *FtSender) trySendDatas(datas []Data, failSleep int) (err error) {
+	failDatas, binaryUnpack, err := ft.attemptSend(datas)
+	if err != nil {
+		ft.enqueueRetry(failDatas, binaryUnpack, err, 0, time.Time{})
+		time.Sleep(time.Second * time.Duration(failSleep))
+	}
+	return
+}
+
+// trySendEnvelope 从 backup queue 里取出一条带重试信息的记录，尝试发送；
+// 失败时沿用原有的 retries/firstFailedAt 继续走 enqueueRetry 的重试/dead letter 规则
+func (ft *FtSender) trySendEnvelope(dat []byte, failSleep int) (err error) {
+	env, err := ft.decodeEnvelope(dat)
+	if err != nil {
+		return err
+	}
+	failDatas, binaryUnpack, err := ft.attemptSend(env.Datas)
+	if err != nil {
+		ft.enqueueRetry(failDatas, binaryUnpack, err, env.Retries, env.FirstFailedAt)
+		time.Sleep(time.Second * time.Duration(failSleep))
+	}
+	return
+}
+
+func (ft *FtSender) sendFromStreamQueue(quit chan struct{}) {
+	defer ft.shardWg.Done()
 	readChan := ft.logQueue.ReadChan()
 	timer := time.NewTicker(time.Second)
+	defer timer.Stop()
 	for {
 		if atomic.LoadInt32(&ft.stopped) > 0 {
-			ft.exitChan <- struct{}{}
+			atomic.AddInt32(&ft.curProcs, -1)
 			return
 		}
 		select {
+		case <-quit:
+			// 优雅缩容：不再读取新的数据，直接退出
+			atomic.AddInt32(&ft.curProcs, -1)
+			return
 		case dat := <-readChan:
-			err := ft.trySendBytes(dat, 1)
+			start := time.Now()
+			n, err := ft.trySendBytes(dat, 1)
 			if err != nil {
 				log.Errorf("%s cannot send points from queue %v, error %v", ft.innerSender.Name(), ft.logQueue.Name(), err)
 				ft.se.AddErrors()
 			} else {
+				atomic.AddInt64(&ft.samplesOut, int64(n))
+				atomic.AddInt64(&ft.samplesOutNs, int64(time.Since(start)))
 				ft.se.AddSuccess()
 			}
 		case <-timer.C:
@@ -261,7 +742,7 @@ func (ft *FtSender) retryFromBackupQueue() {
 		}
 		select {
 		case dat := <-readChan:
-			err := ft.trySendBytes(dat, waitCnt)
+			err := ft.trySendEnvelope(dat, waitCnt)
 			if err == nil {
 				waitCnt = 1
 				ft.se.AddSuccess()
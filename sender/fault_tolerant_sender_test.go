@@ -0,0 +1,53 @@
+package sender
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qiniu/logkit/utils"
+)
+
+// TestShardScaling 校验 addShards/removeShards 能正确地增减 curProcs 以及 shardQuits，
+// 且 removeShards 关闭的 goroutine 会在看到自己的 quit channel 之后自减 curProcs 退出，
+// 不依赖固定的 goroutine 数量假设
+func TestShardScaling(t *testing.T) {
+	q := &fakeBatchQueue{}
+	ft := &FtSender{
+		logQueue: q,
+		se:       &utils.StatsError{Ft: true},
+	}
+
+	ft.addShards(3)
+	if got := atomic.LoadInt32(&ft.curProcs); got != 3 {
+		t.Fatalf("want curProcs=3 after addShards(3), got %d", got)
+	}
+	ft.shardMu.Lock()
+	gotQuits := len(ft.shardQuits)
+	ft.shardMu.Unlock()
+	if gotQuits != 3 {
+		t.Fatalf("want 3 shardQuits after addShards(3), got %d", gotQuits)
+	}
+
+	ft.removeShards(2)
+	waitForCurProcs(t, ft, 1)
+
+	ft.removeShards(1)
+	waitForCurProcs(t, ft, 0)
+
+	ft.shardWg.Wait()
+}
+
+// waitForCurProcs 轮询等待 curProcs 降到 want，sendFromStreamQueue 看到 quit 关闭之后
+// 是异步自减的，不是 removeShards 调用完就立刻生效
+func waitForCurProcs(t *testing.T, ft *FtSender, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&ft.curProcs) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("curProcs did not reach %d within timeout, got %d", want, atomic.LoadInt32(&ft.curProcs))
+}
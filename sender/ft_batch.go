@@ -0,0 +1,140 @@
+package sender
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+// KeyFtBatchMaxRecords/KeyFtBatchMaxBytes/KeyFtBatchMaxLatencyMs 控制 Send 前面的合并缓冲区：
+// 只要命中其中一个阈值(条数/字节数/等待时间)，缓冲区就会被整体落盘一次，用来把高频的小批量 Send
+// 合并成少量大的 disk queue Put，从而降低 Put 次数和 fsync 频率。三个阈值都 <=0 时关闭合并，
+// 行为和升级前一样：每次 Send 都直接落盘
+const (
+	KeyFtBatchMaxRecords   = "ft_batch_max_records"
+	KeyFtBatchMaxBytes     = "ft_batch_max_bytes"
+	KeyFtBatchMaxLatencyMs = "ft_batch_max_latency_ms"
+)
+
+// batchFlusherPollInterval 后台 flush goroutine 检查 ft_batch_max_latency_ms 是否到期的轮询间隔
+const batchFlusherPollInterval = 100 * time.Millisecond
+
+// batchRetryBackoff flushBatch 落盘失败、把数据重新放回缓冲区之后，等多久再重试一次，
+// 避免 disk quota 之类的持续性错误让 flusher 原地打转
+const batchRetryBackoff = time.Second
+
+// batchingEnabled 只要三个阈值任意一个 >0 就认为开启了合并缓冲
+func (ft *FtSender) batchingEnabled() bool {
+	return ft.batchMaxRecords > 0 || ft.batchMaxBytes > 0 || ft.batchMaxLatency > 0
+}
+
+// appendBatch 把 datas 追加进合并缓冲区；命中条数或字节数阈值时唤醒 flusher 立刻落盘。
+// 注意：缓冲区只在内存里，进程崩溃会丢失还没落盘的数据，调用方可以在关键检查点调 Flush() 兜底
+func (ft *FtSender) appendBatch(datas []Data) {
+	ft.batchMu.Lock()
+	if len(ft.batchDatas) == 0 {
+		ft.batchOldest = time.Now()
+	}
+	ft.batchDatas = append(ft.batchDatas, datas...)
+	if bs, err := json.Marshal(datasContext{Datas: datas}); err == nil {
+		ft.batchBytes += len(bs)
+	}
+	full := (ft.batchMaxRecords > 0 && len(ft.batchDatas) >= ft.batchMaxRecords) ||
+		(ft.batchMaxBytes > 0 && ft.batchBytes >= ft.batchMaxBytes)
+	// 上一次 flush 失败后的退避期内不唤醒 flusher，退避结束后由 flushIfStale 重试
+	full = full && !time.Now().Before(ft.batchRetryAt)
+	ft.batchMu.Unlock()
+
+	if full {
+		ft.signalFlush()
+	}
+}
+
+func (ft *FtSender) signalFlush() {
+	select {
+	case ft.flushSignal <- struct{}{}:
+	default:
+		// flusher 已经有一个待处理的 flush 信号了，这次不用再排队
+	}
+}
+
+// batchFlusher 后台每隔 batchFlusherPollInterval 轮询一次(检查 ft_batch_max_latency_ms、重试退避以及
+// Close 设置的 stopped)，或者被 appendBatch 唤醒，负责把合并缓冲区里的数据落盘。goroutine 退出前调用 batchWg.Done()，Close 会等它退出之后才去关
+// logQueue/backupQueue，避免两边产生竞态
+func (ft *FtSender) batchFlusher() {
+	defer ft.batchWg.Done()
+	ticker := time.NewTicker(batchFlusherPollInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt32(&ft.stopped) > 0 {
+			ft.flushBatch()
+			return
+		}
+		select {
+		case <-ft.flushSignal:
+			ft.flushBatch()
+		case <-ticker.C:
+			ft.flushIfStale()
+		}
+	}
+}
+
+// flushIfStale 在缓冲区里最老的数据已经等了超过 ft_batch_max_latency_ms，或者上一次 flush
+// 失败、重试退避时间已经到了，触发一次落盘；退避期内两种情况都不触发
+func (ft *FtSender) flushIfStale() {
+	ft.batchMu.Lock()
+	backingOff := time.Now().Before(ft.batchRetryAt)
+	stale := !backingOff && ft.batchMaxLatency > 0 && len(ft.batchDatas) > 0 && time.Since(ft.batchOldest) >= ft.batchMaxLatency
+	retryDue := !ft.batchRetryAt.IsZero() && len(ft.batchDatas) > 0 && !time.Now().Before(ft.batchRetryAt)
+	ft.batchMu.Unlock()
+	if stale || retryDue {
+		ft.flushBatch()
+	}
+}
+
+// Flush 立刻把合并缓冲区里还没落盘的数据写入 disk queue；
+// 因为缓冲区只在内存里，调用方可以在自己的关键检查点调用它，降低崩溃丢数据的窗口
+func (ft *FtSender) Flush() error {
+	return ft.flushBatch()
+}
+
+// flushBatch 把当前缓冲区整体落盘。落盘失败(比如 marshal 出错，或者 ft_overflow_policy 触发的
+// ErrDiskQueueFull)时把这批数据重新放回缓冲区最前面，等 batchRetryBackoff 之后再重试，而不是
+// 像之前那样直接丢弃 —— 合并缓冲只承诺"进程崩溃会丢失内存里还没落盘的数据"，常规的落盘错误
+// 应该和关闭合并时一样可以重试，不应该变成静默的永久丢数据
+func (ft *FtSender) flushBatch() error {
+	ft.batchMu.Lock()
+	if len(ft.batchDatas) == 0 {
+		ft.batchMu.Unlock()
+		return nil
+	}
+	datas := ft.batchDatas
+	bytes := ft.batchBytes
+	ft.batchDatas = nil
+	ft.batchBytes = 0
+	ft.batchMu.Unlock()
+
+	if err := ft.saveToFile(datas); err != nil {
+		log.Errorf("%s cannot flush coalesced batch of %d datas, will retry in %s: %v", ft.innerSender.Name(), len(datas), batchRetryBackoff, err)
+		ft.se.AddErrors()
+		ft.requeueBatch(datas, bytes)
+		return err
+	}
+
+	ft.batchMu.Lock()
+	ft.batchRetryAt = time.Time{}
+	ft.batchMu.Unlock()
+	return nil
+}
+
+// requeueBatch 把落盘失败的一批数据重新放回缓冲区最前面(保留它们在 datas 里原有的顺序)，
+// 等下一次到期的 flush 再试一遍
+func (ft *FtSender) requeueBatch(datas []Data, bytes int) {
+	ft.batchMu.Lock()
+	ft.batchDatas = append(datas, ft.batchDatas...)
+	ft.batchBytes += bytes
+	ft.batchRetryAt = time.Now().Add(batchRetryBackoff)
+	ft.batchMu.Unlock()
+}
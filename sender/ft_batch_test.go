@@ -0,0 +1,62 @@
+package sender
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/qiniu/logkit/utils"
+)
+
+// fakeBatchQueue 是一个只统计 Put 调用次数的最简单 queue.BackendQueue 实现，不真正落盘，
+// 用来衡量合并缓冲对 disk queue Put 频率(进而是 fsync 频率)的影响
+type fakeBatchQueue struct {
+	puts int64
+}
+
+func (q *fakeBatchQueue) Put(bs []byte) error     { atomic.AddInt64(&q.puts, 1); return nil }
+func (q *fakeBatchQueue) ReadChan() <-chan []byte { return nil }
+func (q *fakeBatchQueue) Depth() int64            { return 0 }
+func (q *fakeBatchQueue) Close() error            { return nil }
+func (q *fakeBatchQueue) Name() string            { return "fake" }
+
+func newBenchFtSender(batchMaxRecords int) (*FtSender, *fakeBatchQueue) {
+	q := &fakeBatchQueue{}
+	return &FtSender{
+		logQueue:        q,
+		backupQueue:     q,
+		codec:           payloadCodecs[CodecJSON],
+		se:              &utils.StatsError{Ft: true},
+		batchMaxRecords: batchMaxRecords,
+		flushSignal:     make(chan struct{}, 1),
+	}, q
+}
+
+// BenchmarkFtSenderBatching 对比关闭/开启 ft_batch_max_records 时，同样数量的单条 Send 调用
+// 各自触发多少次 disk queue Put：开启合并缓冲应该把 Put 次数从"每次 Send 一次"降到"每
+// batchMaxRecords 次 Send 一次"，Put次数/op 的 Metric 就是降低的 Put/fsync 频率
+func BenchmarkFtSenderBatching(b *testing.B) {
+	data := []Data{{"a": "b"}}
+
+	b.Run("unbatched", func(b *testing.B) {
+		ft, q := newBenchFtSender(0)
+		for i := 0; i < b.N; i++ {
+			ft.Send(data)
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&q.puts))/float64(b.N), "puts/op")
+	})
+
+	b.Run("batched_100_records", func(b *testing.B) {
+		ft, q := newBenchFtSender(100)
+		for i := 0; i < b.N; i++ {
+			ft.Send(data)
+			// 这里没有启动 batchFlusher，由循环代替它同步处理 appendBatch 发出的 flush 信号
+			select {
+			case <-ft.flushSignal:
+				ft.flushBatch()
+			default:
+			}
+		}
+		ft.flushBatch()
+		b.ReportMetric(float64(atomic.LoadInt64(&q.puts))/float64(b.N), "puts/op")
+	})
+}
@@ -0,0 +1,226 @@
+package sender
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+// KeyFtMaxRetries 一条数据最多重试多少次，超过之后会被当成 dead letter 丢弃
+// KeyFtDeadLetterPath 被放弃的数据写到哪个目录下，留空表示只丢弃不落盘
+const (
+	KeyFtMaxRetries     = "ft_max_retries"
+	KeyFtDeadLetterPath = "ft_dead_letter_path"
+)
+
+const (
+	defaultMaxRetries = 10
+
+	// deadLetterFileName dead letter 落盘的文件名，写满之后按 deadLetterMaxFileSize 滚动
+	deadLetterFileName = "dead_letter.log"
+	// deadLetterMaxFileSize 单个 dead letter 文件最大体积，超过后以时间戳重命名滚动出去
+	deadLetterMaxFileSize = maxBytesPerFile
+)
+
+// ftEnvelopeMeta 是 backup queue 里每条记录附带的重试元信息
+type ftEnvelopeMeta struct {
+	Retries       int       `json:"retries"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastErr       string    `json:"last_err"`
+	Poison        bool      `json:"poison,omitempty"`
+}
+
+// ftRetryEnvelope 是 backup queue 里实际存储的单位：原始数据外面包一层重试元信息
+type ftRetryEnvelope struct {
+	ftEnvelopeMeta
+	Datas []Data
+}
+
+// DeadLetterRecord 是落盘到 ft_dead_letter_path 里的一条记录，供 InspectDeadLetters 读取
+type DeadLetterRecord struct {
+	Retries       int       `json:"retries"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastErr       string    `json:"last_err"`
+	Poison        bool      `json:"poison"`
+	Datas         []Data    `json:"datas"`
+}
+
+// encodeEnvelope 把重试元信息和 Datas 编码成 backup queue 里的一条记录：
+// 1 字节 codec header + 4 字节大端长度的元信息 json + ft.codec 编码后的 Datas
+func (ft *FtSender) encodeEnvelope(env *ftRetryEnvelope) ([]byte, error) {
+	metaBytes, err := json.Marshal(env.ftEnvelopeMeta)
+	if err != nil {
+		return nil, err
+	}
+	datasBytes, err := ft.codec.Marshal(env.Datas)
+	if err != nil {
+		return nil, err
+	}
+	header, ok := codecHeaderByName[ft.codec.Name()]
+	if !ok {
+		header = codecHeaderJSON
+	}
+
+	bs := make([]byte, 0, 1+4+len(metaBytes)+len(datasBytes))
+	bs = append(bs, header)
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(metaBytes)))
+	bs = append(bs, lenBuf[:]...)
+	bs = append(bs, metaBytes...)
+	bs = append(bs, datasBytes...)
+	return bs, nil
+}
+
+// decodeEnvelope 解析 encodeEnvelope 写出的记录；如果格式对不上(比如这是 codec 特性上线后、
+// 重试信息上线前写入的、没有重试元信息的老格式 backup queue 数据)，退化为 decodePayload 按第 0 次重试处理
+func (ft *FtSender) decodeEnvelope(dat []byte) (*ftRetryEnvelope, error) {
+	if env, ok := ft.tryDecodeEnvelope(dat); ok {
+		return env, nil
+	}
+	datas, err := ft.decodePayload(dat)
+	if err != nil {
+		return nil, err
+	}
+	return &ftRetryEnvelope{Datas: datas}, nil
+}
+
+func (ft *FtSender) tryDecodeEnvelope(dat []byte) (*ftRetryEnvelope, bool) {
+	if len(dat) < 5 {
+		return nil, false
+	}
+	codec, ok := codecByHeader(dat[0])
+	if !ok {
+		return nil, false
+	}
+	metaLen := binary.BigEndian.Uint32(dat[1:5])
+	if uint32(len(dat)-5) < metaLen {
+		return nil, false
+	}
+	var meta ftEnvelopeMeta
+	if err := json.Unmarshal(dat[5:5+metaLen], &meta); err != nil {
+		return nil, false
+	}
+	datas, err := codec.Unmarshal(dat[5+metaLen:])
+	if err != nil {
+		return nil, false
+	}
+	return &ftRetryEnvelope{ftEnvelopeMeta: meta, Datas: datas}, true
+}
+
+func (ft *FtSender) deadLetterFilePath() string {
+	return filepath.Join(ft.deadLetterPath, deadLetterFileName)
+}
+
+// writeDeadLetter 放弃一批数据：计数、打日志，如果配置了 ft_dead_letter_path 就追加一行 json 落盘
+func (ft *FtSender) writeDeadLetter(env *ftRetryEnvelope) {
+	atomic.AddInt64(&ft.deadLetters, 1)
+	log.Errorf("%s giving up on %d datas after %d retries(poison=%v): %v",
+		ft.innerSender.Name(), len(env.Datas), env.Retries, env.Poison, env.LastErr)
+
+	if ft.deadLetterPath == "" {
+		return
+	}
+	rec := DeadLetterRecord{
+		Retries:       env.Retries,
+		FirstFailedAt: env.FirstFailedAt,
+		LastErr:       env.LastErr,
+		Poison:        env.Poison,
+		Datas:         env.Datas,
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("%s cannot marshal dead letter record: %v", ft.innerSender.Name(), err)
+		return
+	}
+
+	ft.deadLetterMu.Lock()
+	defer ft.deadLetterMu.Unlock()
+	if err := ft.rotateDeadLetterFileIfNeeded(); err != nil {
+		log.Errorf("%s cannot rotate dead letter file: %v", ft.innerSender.Name(), err)
+	}
+	f, err := os.OpenFile(ft.deadLetterFilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Errorf("%s cannot open dead letter file %q: %v", ft.innerSender.Name(), ft.deadLetterFilePath(), err)
+		return
+	}
+	defer f.Close()
+	f.Write(line)
+	f.Write([]byte("\n"))
+}
+
+// rotateDeadLetterFileIfNeeded 在当前 dead letter 文件超过 deadLetterMaxFileSize 时把它改名滚动出去，
+// 调用方需要持有 deadLetterMu
+func (ft *FtSender) rotateDeadLetterFileIfNeeded() error {
+	path := ft.deadLetterFilePath()
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < deadLetterMaxFileSize {
+		return nil
+	}
+	return os.Rename(path, path+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+// DeadLetters 返回累计被放弃(写入 dead letter)的批次数，供监控展示。
+//
+// 理想情况下这应该是 Send 返回的 utils.StatsError 上的一个 DeadLetters 字段，但 utils 是
+// github.com/qiniu/logkit/utils 里的外部包，这个代码快照没有它的源码(没有 go.mod/vendor)，
+// 没法给 utils.StatsError 加字段，所以只能单独开一个方法暴露同样的计数
+func (ft *FtSender) DeadLetters() int64 {
+	return atomic.LoadInt64(&ft.deadLetters)
+}
+
+// InspectDeadLetters 读取当前 dead letter 文件里最近写入的记录，供运维排查被丢弃的数据；
+// limit <= 0 表示不限制条数
+func (ft *FtSender) InspectDeadLetters(limit int) ([]DeadLetterRecord, error) {
+	if ft.deadLetterPath == "" {
+		return nil, nil
+	}
+
+	ft.deadLetterMu.Lock()
+	defer ft.deadLetterMu.Unlock()
+
+	f, err := os.Open(ft.deadLetterFilePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []DeadLetterRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), deadLetterMaxFileSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec DeadLetterRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return records, fmt.Errorf("ft: cannot parse dead letter record: %v", err)
+		}
+		records = append(records, rec)
+		if limit > 0 && len(records) > limit {
+			// 只保留最近写入的 limit 条
+			records = records[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return records, err
+	}
+	return records, nil
+}
@@ -0,0 +1,121 @@
+package sender
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qiniu/logkit/utils"
+)
+
+// capturingQueue 是一个只把 Put 进来的内容存进 slice 的 queue.BackendQueue 实现，
+// 用来断言 enqueueRetry 到底有没有把信封放进 backupQueue
+type capturingQueue struct {
+	mu   sync.Mutex
+	puts [][]byte
+}
+
+func (q *capturingQueue) Put(bs []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.puts = append(q.puts, bs)
+	return nil
+}
+func (q *capturingQueue) ReadChan() <-chan []byte { return nil }
+func (q *capturingQueue) Depth() int64            { return 0 }
+func (q *capturingQueue) Close() error            { return nil }
+func (q *capturingQueue) Name() string            { return "capturing" }
+
+func (q *capturingQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.puts)
+}
+
+// namedTestSender 是一个最简单的 Sender 实现，writeDeadLetter 打日志时会调用 innerSender.Name()
+type namedTestSender struct{}
+
+func (namedTestSender) Name() string            { return "test" }
+func (namedTestSender) Send(datas []Data) error { return nil }
+func (namedTestSender) Close() error            { return nil }
+
+func newDeadLetterTestSender(maxRetries int) (*FtSender, *capturingQueue) {
+	backup := &capturingQueue{}
+	ft := &FtSender{
+		innerSender: namedTestSender{},
+		backupQueue: backup,
+		codec:       payloadCodecs[CodecJSON],
+		se:          &utils.StatsError{Ft: true},
+		maxRetries:  maxRetries,
+	}
+	return ft, backup
+}
+
+// TestEnqueueRetryNormal 校验一条普通(非 poison、没超过 maxRetries)的失败数据会被编码后
+// 放进 backupQueue，而不是直接进 dead letter，并且编码/解码一个来回拿回来的数据和重试元信息不变
+func TestEnqueueRetryNormal(t *testing.T) {
+	ft, backup := newDeadLetterTestSender(3)
+	datas := []Data{{"a": "b"}}
+
+	ft.enqueueRetry(datas, false, errors.New("boom"), 0, time.Time{})
+
+	if backup.len() != 1 {
+		t.Fatalf("want 1 envelope in backupQueue, got %d", backup.len())
+	}
+	if got := ft.DeadLetters(); got != 0 {
+		t.Fatalf("want 0 dead letters for a normal retry, got %d", got)
+	}
+
+	env, err := ft.decodeEnvelope(backup.puts[0])
+	if err != nil {
+		t.Fatalf("decodeEnvelope: %v", err)
+	}
+	if env.Retries != 1 {
+		t.Fatalf("want Retries=1 after first failure, got %d", env.Retries)
+	}
+	if env.Poison {
+		t.Fatalf("a non-binaryUnpack single-record failure must not be marked poison")
+	}
+	if len(env.Datas) != 1 || env.Datas[0]["a"] != "b" {
+		t.Fatalf("round-tripped data mismatch: %+v", env.Datas)
+	}
+}
+
+// TestEnqueueRetryExceedsMaxRetries 校验超过 ft_max_retries 之后数据进 dead letter，
+// 不再放进 backupQueue 里无限重试
+func TestEnqueueRetryExceedsMaxRetries(t *testing.T) {
+	ft, backup := newDeadLetterTestSender(1)
+	datas := []Data{{"a": "b"}}
+
+	// 第一次失败：retries 0->1，还在 maxRetries(1) 以内，应该进 backupQueue
+	ft.enqueueRetry(datas, false, errors.New("boom"), 0, time.Time{})
+	if backup.len() != 1 {
+		t.Fatalf("want 1 envelope in backupQueue after first failure, got %d", backup.len())
+	}
+
+	// 第二次失败：retries 1->2，超过 maxRetries(1)，应该进 dead letter 而不是 backupQueue
+	ft.enqueueRetry(datas, false, errors.New("boom again"), 1, time.Time{})
+	if backup.len() != 1 {
+		t.Fatalf("want backupQueue to stay at 1 once retries exceed maxRetries, got %d", backup.len())
+	}
+	if got := ft.DeadLetters(); got != 1 {
+		t.Fatalf("want 1 dead letter once retries exceed maxRetries, got %d", got)
+	}
+}
+
+// TestEnqueueRetryPoison 校验 binaryUnpack 拆到只剩一条还是失败的 poison 数据直接进 dead letter，
+// 不会继续占着 backupQueue 重试(这条数据本身就是导致 innerSender 报错的元凶，重试也不会成功)
+func TestEnqueueRetryPoison(t *testing.T) {
+	ft, backup := newDeadLetterTestSender(10)
+	datas := []Data{{"a": "b"}}
+
+	ft.enqueueRetry(datas, true, errors.New("cannot unpack"), 0, time.Time{})
+
+	if backup.len() != 0 {
+		t.Fatalf("want poison data to skip backupQueue, got %d puts", backup.len())
+	}
+	if got := ft.DeadLetters(); got != 1 {
+		t.Fatalf("want 1 dead letter for poison data, got %d", got)
+	}
+}
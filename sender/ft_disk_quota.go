@@ -0,0 +1,173 @@
+package sender
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+// KeyFtMaxDiskUsageMB ft 两个 disk queue 加起来允许占用的磁盘空间，单位 MB，<=0 表示不限制
+// KeyFtOverflowPolicy 磁盘用量超过 KeyFtMaxDiskUsageMB 之后的处理策略，见下面的 OverflowPolicy* 常量
+// KeyFtBlockTimeout KeyFtOverflowPolicy 为 block 时最多阻塞多久(单位秒)，超时后按 error 处理
+const (
+	KeyFtMaxDiskUsageMB = "ft_max_disk_usage_mb"
+	KeyFtOverflowPolicy = "ft_overflow_policy"
+	KeyFtBlockTimeout   = "ft_block_timeout"
+)
+
+// ft_overflow_policy 的取值
+const (
+	OverflowPolicyBlock      = "block"       // 阻塞等待磁盘用量降下去，超过 ft_block_timeout 还没降下去则报错
+	OverflowPolicyDropOldest = "drop_oldest" // 丢弃 logQueue 里最老的数据腾地方，logQueue 没有数据时改丢 backupQueue 里最老的
+	OverflowPolicyDropNewest = "drop_newest" // 拒绝这一批新数据
+	OverflowPolicyError      = "error"       // 直接返回 ErrDiskQueueFull，让上层决定怎么处理
+)
+
+const (
+	defaultOverflowPolicy  = OverflowPolicyBlock
+	defaultBlockTimeoutSec = 30
+
+	// diskUsagePollInterval 轮询 save log 目录磁盘占用的间隔
+	diskUsagePollInterval = 5 * time.Second
+	// blockPollInterval ft_overflow_policy=block 时，每隔多久重新检查一次磁盘用量是否已经降下去
+	blockPollInterval = 200 * time.Millisecond
+)
+
+// ErrDiskQueueFull 在磁盘用量超过 ft_max_disk_usage_mb 且策略为 error(或 drop_newest、block 超时、
+// drop_oldest 两个 queue 都没有数据可丢)时返回，
+// 调用方可以用类型断言识别出这个错误，把数据转发给其他 sender 兜底
+type ErrDiskQueueFull struct {
+	Path  string
+	Usage int64
+	Limit int64
+}
+
+func (e *ErrDiskQueueFull) Error() string {
+	return fmt.Sprintf("ft: disk queue at %q is full, usage %d bytes exceeds limit %d bytes", e.Path, e.Usage, e.Limit)
+}
+
+// DiskQuotaStats 对外暴露 ft 磁盘配额的当前状态，供监控/UI 展示
+type DiskQuotaStats struct {
+	UsageBytes    int64  `json:"usage_bytes"`
+	LimitBytes    int64  `json:"limit_bytes"`
+	Policy        string `json:"policy"`
+	DroppedOldest int64  `json:"dropped_oldest"`
+	DroppedNewest int64  `json:"dropped_newest"`
+}
+
+// DiskQuotaStats 返回当前磁盘配额状态。
+//
+// 这本该是 utils.StatsError 上的字段，但 utils.StatsError 属于 github.com/qiniu/logkit/utils
+// 这个外部包，当前代码快照里没有它的源码(没有 go.mod/vendor)，没法直接给它加字段，因此单独
+// 开了这个方法
+func (ft *FtSender) DiskQuotaStats() DiskQuotaStats {
+	return DiskQuotaStats{
+		UsageBytes:    atomic.LoadInt64(&ft.diskUsageBytes),
+		LimitBytes:    ft.maxDiskUsage,
+		Policy:        ft.overflowPolicy,
+		DroppedOldest: atomic.LoadInt64(&ft.droppedOldest),
+		DroppedNewest: atomic.LoadInt64(&ft.droppedNewest),
+	}
+}
+
+// checkDiskQuota 在往 disk queue 里写之前检查磁盘用量是否超过 ft_max_disk_usage_mb。
+// allow=true 时调用方可以正常写入；allow=false 时调用方应该放弃这次写入，err 说明了原因
+func (ft *FtSender) checkDiskQuota() (allow bool, err error) {
+	if ft.maxDiskUsage <= 0 {
+		return true, nil
+	}
+	usage := atomic.LoadInt64(&ft.diskUsageBytes)
+	if usage < ft.maxDiskUsage {
+		return true, nil
+	}
+
+	switch ft.overflowPolicy {
+	case OverflowPolicyDropOldest:
+		// inner sender 挂掉时 logQueue 往往已经被 sendFromStreamQueue 读空、真正堆积的是
+		// backupQueue 里的重试信封，所以两个 queue 都要尝试丢；如果两个都没丢到东西(没有
+		// 数据可丢，或者都在被正常消费)，说明这次没有真正腾出空间，不能当作 allow=true 放行，
+		// 否则磁盘用量还是会无限增长，配额形同虚设
+		if ft.dropOldest() {
+			atomic.AddInt64(&ft.droppedOldest, 1)
+			return true, nil
+		}
+		return false, &ErrDiskQueueFull{Path: ft.saveLogPath, Usage: usage, Limit: ft.maxDiskUsage}
+	case OverflowPolicyDropNewest:
+		atomic.AddInt64(&ft.droppedNewest, 1)
+		return false, &ErrDiskQueueFull{Path: ft.saveLogPath, Usage: usage, Limit: ft.maxDiskUsage}
+	case OverflowPolicyError:
+		return false, &ErrDiskQueueFull{Path: ft.saveLogPath, Usage: usage, Limit: ft.maxDiskUsage}
+	default: // OverflowPolicyBlock
+		deadline := time.Now().Add(ft.blockTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(blockPollInterval)
+			if usage = atomic.LoadInt64(&ft.diskUsageBytes); usage < ft.maxDiskUsage {
+				return true, nil
+			}
+		}
+		return false, &ErrDiskQueueFull{Path: ft.saveLogPath, Usage: usage, Limit: ft.maxDiskUsage}
+	}
+}
+
+// dropOldest 优先从 logQueue 取出并丢弃最老的一条数据腾地方；logQueue 里没有数据可丢时
+// (典型场景就是 inner sender 挂掉、logQueue 已经被消费干净，真正占地方的是 backupQueue 里
+// 堆积的重试信封)改从 backupQueue 丢。两边都没有数据可丢时返回 false，调用方不应该当作已经
+// 腾出空间
+func (ft *FtSender) dropOldest() bool {
+	select {
+	case <-ft.logQueue.ReadChan():
+		return true
+	default:
+	}
+	select {
+	case <-ft.backupQueue.ReadChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// pollDiskUsage 定期统计 ft.diskUsageDirs 里每个目录下所有文件的体积之和，作为 checkDiskQuota
+// 的依据。disk 模式下这就是 saveLogPath 一个目录；rs 模式下数据分散在各自独立的 ft_rs_paths
+// 分片目录里，必须把它们都加起来，否则 ft_max_disk_usage_mb/ft_overflow_policy 在 rs 模式下就
+// 只会看到 saveLogPath 里几乎空的内容，永远不会触发。DiskQueue 本身没有暴露已写字节数，轮询
+// 目录大小是最简单、和具体 queue 实现无关的办法
+func (ft *FtSender) pollDiskUsage() {
+	ticker := time.NewTicker(diskUsagePollInterval)
+	defer ticker.Stop()
+	for {
+		if atomic.LoadInt32(&ft.stopped) > 0 {
+			return
+		}
+		var total int64
+		for _, dir := range ft.diskUsageDirs {
+			usage, err := dirSize(dir)
+			if err != nil {
+				log.Errorf("%s cannot stat disk usage under %q: %v", ft.innerSender.Name(), dir, err)
+				continue
+			}
+			total += usage
+		}
+		atomic.StoreInt64(&ft.diskUsageBytes, total)
+		<-ticker.C
+	}
+}
+
+// dirSize 返回 path 目录下所有普通文件大小之和
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
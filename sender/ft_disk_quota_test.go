@@ -0,0 +1,95 @@
+package sender
+
+import "testing"
+
+// readableQueue 是一个 queue.BackendQueue 实现，ReadChan 背后是一个真正可读的 buffered
+// channel，用来在测试里模拟 logQueue/backupQueue 里"还有/没有数据可丢"这两种状态
+type readableQueue struct {
+	ch chan []byte
+}
+
+func newReadableQueue(n int) *readableQueue {
+	return &readableQueue{ch: make(chan []byte, n)}
+}
+
+func (q *readableQueue) Put(bs []byte) error     { q.ch <- bs; return nil }
+func (q *readableQueue) ReadChan() <-chan []byte { return q.ch }
+func (q *readableQueue) Depth() int64            { return int64(len(q.ch)) }
+func (q *readableQueue) Close() error            { return nil }
+func (q *readableQueue) Name() string            { return "readable" }
+
+func newDiskQuotaTestSender(policy string, usage, limit int64) (*FtSender, *readableQueue, *readableQueue) {
+	logQ := newReadableQueue(4)
+	backupQ := newReadableQueue(4)
+	ft := &FtSender{
+		logQueue:       logQ,
+		backupQueue:    backupQ,
+		maxDiskUsage:   limit,
+		overflowPolicy: policy,
+	}
+	ft.diskUsageBytes = usage
+	return ft, logQ, backupQ
+}
+
+// TestCheckDiskQuotaDropOldestDrainsBackupQueue 覆盖 review 指出的场景：inner sender 挂掉，
+// logQueue 已经被 sendFromStreamQueue 读空，真正堆积的是 backupQueue 里的重试信封。
+// drop_oldest 策略应该改从 backupQueue 丢一条，并且仍然放行这次写入
+func TestCheckDiskQuotaDropOldestDrainsBackupQueue(t *testing.T) {
+	ft, _, backupQ := newDiskQuotaTestSender(OverflowPolicyDropOldest, 100, 10)
+	backupQ.Put([]byte("oldest-retry-envelope"))
+
+	allow, err := ft.checkDiskQuota()
+	if !allow || err != nil {
+		t.Fatalf("want allow=true err=nil when backupQueue has something to drop, got allow=%v err=%v", allow, err)
+	}
+	if depth := backupQ.Depth(); depth != 0 {
+		t.Fatalf("want backupQueue drained by one, depth=%d", depth)
+	}
+	if got := ft.droppedOldest; got != 1 {
+		t.Fatalf("want droppedOldest=1, got %d", got)
+	}
+}
+
+// TestCheckDiskQuotaDropOldestNothingToDrop 覆盖 review 指出的 bug：两个 queue 都没有数据可丢时，
+// drop_oldest 不能再无条件放行，否则磁盘用量会无限增长，配额形同虚设
+func TestCheckDiskQuotaDropOldestNothingToDrop(t *testing.T) {
+	ft, _, _ := newDiskQuotaTestSender(OverflowPolicyDropOldest, 100, 10)
+
+	allow, err := ft.checkDiskQuota()
+	if allow {
+		t.Fatalf("want allow=false when neither logQueue nor backupQueue has anything to drop")
+	}
+	if err == nil {
+		t.Fatalf("want a non-nil error when rejecting the write")
+	}
+	if _, ok := err.(*ErrDiskQueueFull); !ok {
+		t.Fatalf("want *ErrDiskQueueFull, got %T", err)
+	}
+}
+
+// TestCheckDiskQuotaDropNewestRejects 校验 drop_newest 策略在超限时直接拒绝这次写入
+func TestCheckDiskQuotaDropNewestRejects(t *testing.T) {
+	ft, logQ, _ := newDiskQuotaTestSender(OverflowPolicyDropNewest, 100, 10)
+	logQ.Put([]byte("something")) // 即使有数据可丢，drop_newest 也不应该去丢它
+
+	allow, err := ft.checkDiskQuota()
+	if allow || err == nil {
+		t.Fatalf("want drop_newest to reject the write, got allow=%v err=%v", allow, err)
+	}
+	if depth := logQ.Depth(); depth != 1 {
+		t.Fatalf("drop_newest must not touch logQueue, depth=%d", depth)
+	}
+	if got := ft.droppedNewest; got != 1 {
+		t.Fatalf("want droppedNewest=1, got %d", got)
+	}
+}
+
+// TestCheckDiskQuotaUnderLimitAllows 校验用量没超限时，无论策略是什么都直接放行
+func TestCheckDiskQuotaUnderLimitAllows(t *testing.T) {
+	ft, _, _ := newDiskQuotaTestSender(OverflowPolicyError, 5, 10)
+
+	allow, err := ft.checkDiskQuota()
+	if !allow || err != nil {
+		t.Fatalf("want allow=true err=nil when usage is under the limit, got allow=%v err=%v", allow, err)
+	}
+}
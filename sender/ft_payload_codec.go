@@ -0,0 +1,255 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vmihailenco/msgpack"
+)
+
+// KeyFtPayloadCodec 控制 disk queue 中每条数据用什么格式编码
+const KeyFtPayloadCodec = "ft_payload_codec"
+
+// 支持的 payload codec 名称
+const (
+	CodecJSON     = "json" // 默认值，保持和升级前一致的行为
+	CodecMsgpack  = "msgpack"
+	CodecProtobuf = "protobuf"
+)
+
+// codec header 魔数，写在每条 disk queue payload 最前面的一个字节，标识后面的数据用哪种 PayloadCodec 编码。
+// 三个魔数都选在 json 对象/数组合法的首字节('{' 0x7b, '[' 0x5b)之外，
+// 这样老版本直接写入的、不带 header 的 json payload 才能和新格式区分开，保证旧 spool 不会丢数据
+const (
+	codecHeaderJSON     byte = 0x01
+	codecHeaderMsgpack  byte = 0x02
+	codecHeaderProtobuf byte = 0x03
+)
+
+// PayloadCodec 定义 ft disk queue 里一条 payload（一个 []Data 批次）的编解码方式
+type PayloadCodec interface {
+	Marshal(datas []Data) ([]byte, error)
+	Unmarshal(data []byte) ([]Data, error)
+	Name() string
+}
+
+var payloadCodecs = map[string]PayloadCodec{
+	CodecJSON:     jsonCodec{},
+	CodecMsgpack:  msgpackCodec{},
+	CodecProtobuf: protobufCodec{},
+}
+
+var codecHeaderByName = map[string]byte{
+	CodecJSON:     codecHeaderJSON,
+	CodecMsgpack:  codecHeaderMsgpack,
+	CodecProtobuf: codecHeaderProtobuf,
+}
+
+// codecByHeader 返回 header 字节对应的 codec；返回 false 代表这不是一个认识的 header，
+// 调用方应该把整段数据当成升级前写入的、没有 header 的 json payload 来处理
+func codecByHeader(h byte) (PayloadCodec, bool) {
+	switch h {
+	case codecHeaderJSON:
+		return jsonCodec{}, true
+	case codecHeaderMsgpack:
+		return msgpackCodec{}, true
+	case codecHeaderProtobuf:
+		return protobufCodec{}, true
+	}
+	return nil, false
+}
+
+// jsonCodec 是原有的编码方式，保持和升级前完全一致的 wire format
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) Marshal(datas []Data) ([]byte, error) {
+	ctx := &datasContext{Datas: datas}
+	bs, err := json.Marshal(ctx)
+	if err != nil {
+		return nil, NewSendError("Cannot marshal data :"+err.Error(), datas, TypeDefault)
+	}
+	return bs, nil
+}
+
+func (jsonCodec) Unmarshal(dat []byte) ([]Data, error) {
+	ctx := new(datasContext)
+	d := json.NewDecoder(bytes.NewReader(dat))
+	d.UseNumber()
+	if err := d.Decode(ctx); err != nil {
+		return nil, err
+	}
+	return ctx.Datas, nil
+}
+
+// msgpackCodec 用 msgpack 代替 json，省掉 json 的文本开销，数字/时间等类型也更紧凑
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return CodecMsgpack }
+
+func (msgpackCodec) Marshal(datas []Data) ([]byte, error) {
+	bs, err := msgpack.Marshal(datas)
+	if err != nil {
+		return nil, NewSendError("Cannot marshal data to msgpack :"+err.Error(), datas, TypeDefault)
+	}
+	return bs, nil
+}
+
+func (msgpackCodec) Unmarshal(dat []byte) (datas []Data, err error) {
+	err = msgpack.Unmarshal(dat, &datas)
+	return
+}
+
+// protobufCodec 把每条 Data 编码成一个 DataRecord message，再按 varint 长度前缀依次拼接，
+// 这样不需要额外定义一个 repeated 外层 message 就能支持任意条数的批次，解码时按长度切开逐条 proto.Unmarshal 即可
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return CodecProtobuf }
+
+func (protobufCodec) Marshal(datas []Data) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, d := range datas {
+		rec, err := dataToRecord(d)
+		if err != nil {
+			return nil, NewSendError("Cannot marshal data to protobuf :"+err.Error(), datas, TypeDefault)
+		}
+		bs, err := proto.Marshal(rec)
+		if err != nil {
+			return nil, NewSendError("Cannot marshal data to protobuf :"+err.Error(), datas, TypeDefault)
+		}
+		n := binary.PutUvarint(lenBuf[:], uint64(len(bs)))
+		buf.Write(lenBuf[:n])
+		buf.Write(bs)
+	}
+	return buf.Bytes(), nil
+}
+
+func (protobufCodec) Unmarshal(dat []byte) ([]Data, error) {
+	var datas []Data
+	r := bytes.NewReader(dat)
+	for r.Len() > 0 {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		recBytes := make([]byte, size)
+		if _, err := io.ReadFull(r, recBytes); err != nil {
+			return nil, err
+		}
+		rec := new(DataRecord)
+		if err := proto.Unmarshal(recBytes, rec); err != nil {
+			return nil, err
+		}
+		d, err := recordToData(rec)
+		if err != nil {
+			return nil, err
+		}
+		datas = append(datas, d)
+	}
+	return datas, nil
+}
+
+// dataToRecord 把一条 Data(map[string]interface{}) 转成 DataRecord，字段类型映射到 Value 的 oneof 上
+func dataToRecord(d Data) (*DataRecord, error) {
+	fields := make(map[string]*Value, len(d))
+	for k, v := range d {
+		dv, err := toProtoValue(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = dv
+	}
+	return &DataRecord{Fields: fields}, nil
+}
+
+func recordToData(rec *DataRecord) (Data, error) {
+	d := make(Data, len(rec.Fields))
+	for k, v := range rec.Fields {
+		d[k] = fromProtoValue(v)
+	}
+	return d, nil
+}
+
+func toProtoValue(v interface{}) (*Value, error) {
+	switch t := v.(type) {
+	case nil:
+		isNull := true
+		return &Value{IsNull: &isNull}, nil
+	case string:
+		return &Value{StringValue: &t}, nil
+	case bool:
+		return &Value{BoolValue: &t}, nil
+	case []byte:
+		return &Value{BytesValue: t}, nil
+	case float64:
+		return &Value{NumberValue: &t}, nil
+	case float32:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case int:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case int8:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case int16:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case int32:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case int64:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case uint:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case uint8:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case uint16:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case uint32:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case uint64:
+		f := float64(t)
+		return &Value{NumberValue: &f}, nil
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return &Value{NumberValue: &f}, nil
+	default:
+		// 其余嵌套 map/slice 等复杂类型降级为 json 字符串，保证不丢数据，代价是失去强类型
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		s := string(bs)
+		return &Value{StringValue: &s}, nil
+	}
+}
+
+func fromProtoValue(v *Value) interface{} {
+	switch {
+	case v.IsNull != nil && *v.IsNull:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.NumberValue != nil:
+		return *v.NumberValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package sender
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestPayloadCodecsRoundTrip 校验每种 codec 编码再解码之后，标量字段的类型和值都保持不变。
+// protobuf codec 的 toProtoValue 曾经只认得 float64/json.Number，像 Data{"id": 0} 这种
+// 直接塞 int 字面量的写法会落进 default 分支被降级成 json 字符串("0")，这个测试就是用来
+// 防止同样的退化再次发生
+func TestPayloadCodecsRoundTrip(t *testing.T) {
+	datas := []Data{{
+		"int_field":     42,
+		"int64_field":   int64(43),
+		"float32_field": float32(1.5),
+		"float64_field": 2.5,
+		"string_field":  "hello",
+		"bool_field":    true,
+	}}
+
+	for name, codec := range payloadCodecs {
+		codec := codec
+		t.Run(name, func(t *testing.T) {
+			bs, err := codec.Marshal(datas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := codec.Unmarshal(bs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 record, got %d", len(got))
+			}
+
+			for k, want := range datas[0] {
+				gv := got[0][k]
+				wantF, wantIsNum := toComparableNumber(want)
+				gotF, gotIsNum := toComparableNumber(gv)
+				if wantIsNum || gotIsNum {
+					if !wantIsNum || !gotIsNum || wantF != gotF {
+						t.Errorf("field %q: want %v (%T), got %v (%T)", k, want, want, gv, gv)
+					}
+					continue
+				}
+				if !reflect.DeepEqual(want, gv) {
+					t.Errorf("field %q: want %v (%T), got %v (%T)", k, want, want, gv, gv)
+				}
+			}
+		})
+	}
+}
+
+// toComparableNumber 把 codec 解码后可能出现的各种数字表示(float64/json.Number/原生整数)
+// 统一成 float64 以便比较；codec 之间的数字 wire 类型不必完全一致，只要数值相等就算正确往返
+func toComparableNumber(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case int8, int16, int32:
+		return float64(reflect.ValueOf(t).Int()), true
+	case uint, uint8, uint16, uint32, uint64:
+		return float64(reflect.ValueOf(t).Uint()), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	case interface{ Float64() (float64, error) }:
+		f, err := t.Float64()
+		if err != nil {
+			return 0, false
+		}
+		return f, true
+	}
+	return 0, false
+}
+
+// BenchmarkPayloadCodecs 对比 ft_payload_codec 的三种实现(json/msgpack/protobuf)在同一批数据上
+// 编码+解码一个来回的开销，用来在选型时衡量"省 CPU"和"省体积"之间的取舍
+func BenchmarkPayloadCodecs(b *testing.B) {
+	datas := make([]Data, 0, 100)
+	for i := 0; i < 100; i++ {
+		datas = append(datas, Data{
+			"id":      i,
+			"name":    "bench-record",
+			"ts":      "2026-07-30T00:00:00Z",
+			"payload": "some reasonably sized string field to make the marshal cost visible",
+		})
+	}
+
+	for name, codec := range payloadCodecs {
+		codec := codec
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bs, err := codec.Marshal(datas)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.Unmarshal(bs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package sender
+
+import (
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Value/DataRecord 是 ft_payload.proto 里 Value/DataRecord 消息对应的 Go 类型，手写实现
+// proto.Message 接口(Reset/String/ProtoMessage)而不是跑 protoc 生成：这个仓库快照里没有
+// protoc/protoc-gen-go 工具链。struct tag 里的 wire 编号和 ft_payload.proto 保持一致，
+// 所以和真正跑 protoc 生成的代码是线格式兼容的；oneof 在这里简化成了多个互斥的可选字段，
+// 而不是生成器通常会产出的 isValue_Kind 包装类型，修改时两边要一起改，不要照搬真正 protoc
+// 生成的结构覆盖这个文件
+
+// Value is a single field's value inside a DataRecord. Only one of the
+// following is set.
+type Value struct {
+	StringValue *string  `protobuf:"bytes,1,opt,name=string_value,json=stringValue,proto3,oneof"`
+	NumberValue *float64 `protobuf:"fixed64,2,opt,name=number_value,json=numberValue,proto3,oneof"`
+	BoolValue   *bool    `protobuf:"varint,3,opt,name=bool_value,json=boolValue,proto3,oneof"`
+	BytesValue  []byte   `protobuf:"bytes,4,opt,name=bytes_value,json=bytesValue,proto3,oneof"`
+	IsNull      *bool    `protobuf:"varint,5,opt,name=null_value,json=nullValue,proto3,oneof"`
+}
+
+func (m *Value) Reset()         { *m = Value{} }
+func (m *Value) String() string { return proto.CompactTextString(m) }
+func (*Value) ProtoMessage()    {}
+
+// DataRecord mirrors a Go Data (map[string]interface{}) value.
+type DataRecord struct {
+	Fields map[string]*Value `protobuf:"bytes,1,rep,name=fields,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *DataRecord) Reset()         { *m = DataRecord{} }
+func (m *DataRecord) String() string { return proto.CompactTextString(m) }
+func (*DataRecord) ProtoMessage()    {}
@@ -0,0 +1,410 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/qiniu/log"
+	"github.com/qiniu/logkit/queue"
+	"github.com/qiniu/logkit/utils"
+)
+
+// KeyFtStorageMode 选择 ft disk queue 的落盘方式，见下面的 StorageMode* 常量
+// KeyFtRsDataShards/KeyFtRsParityShards/KeyFtRsPaths 仅在 KeyFtStorageMode=rs 时生效：
+// 每条数据会被切成 ft_rs_data_shards 个数据分片，再算出 ft_rs_parity_shards 个校验分片，
+// 分别写到 ft_rs_paths 里对应路径下的 DiskQueue 中；ft_rs_paths 的长度必须正好等于
+// ft_rs_data_shards+ft_rs_parity_shards，并且建议各自落在独立磁盘上，这样单块盘的坏道
+// 最多只会波及一个分片，靠校验分片重建出完整数据
+const (
+	KeyFtStorageMode    = "ft_storage_mode"
+	KeyFtRsDataShards   = "ft_rs_data_shards"
+	KeyFtRsParityShards = "ft_rs_parity_shards"
+	KeyFtRsPaths        = "ft_rs_paths"
+)
+
+// ft_storage_mode 的取值
+const (
+	StorageModeDisk = "disk" // 默认值，单个 DiskQueue，和升级前行为一致
+	StorageModeRS   = "rs"   // 纠删码分片 spool，见上面的说明
+)
+
+const (
+	defaultRsDataShards   = 4
+	defaultRsParityShards = 2
+
+	// shardFrameHeaderLen = 8(seq) + 8(原始数据长度) + 4(分片内容的 crc32)
+	shardFrameHeaderLen = 8 + 8 + 4
+
+	// rsPendingSweepInterval sweepStalePending 检查 pending 窗口里有没有凑不齐分片的 seq 的间隔
+	rsPendingSweepInterval = 30 * time.Second
+	// rsPendingTimeout 一个 seq 在 pending 里等了这么久还凑不齐 dataShards 个有效分片，
+	// 就认为多数据分片同时不可用，永远无法重建，放弃并打日志，避免 pending 无限增长
+	rsPendingTimeout = 5 * time.Minute
+)
+
+// splitRsPaths 按逗号切分 ft_rs_paths，去掉多余的空白
+func splitRsPaths(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.Split(raw, ",")
+	paths := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// encodeShardFrame 给一个分片加上 seq(属于哪个批次)、原始数据长度(去 padding 用)和 crc32(检测损坏用)
+func encodeShardFrame(seq, origLen uint64, shard []byte) []byte {
+	frame := make([]byte, shardFrameHeaderLen+len(shard))
+	binary.BigEndian.PutUint64(frame[0:8], seq)
+	binary.BigEndian.PutUint64(frame[8:16], origLen)
+	binary.BigEndian.PutUint32(frame[16:20], crc32.ChecksumIEEE(shard))
+	copy(frame[20:], shard)
+	return frame
+}
+
+// decodeShardFrame 解析 encodeShardFrame 写出的一帧；ok=false 代表长度不对或者 crc32 校验失败，
+// 也就是这个分片已经损坏，调用方应该把它当成丢失的分片，靠其它分片重建
+func decodeShardFrame(frame []byte) (seq, origLen uint64, payload []byte, ok bool) {
+	if len(frame) < shardFrameHeaderLen {
+		return 0, 0, nil, false
+	}
+	seq = binary.BigEndian.Uint64(frame[0:8])
+	origLen = binary.BigEndian.Uint64(frame[8:16])
+	sum := binary.BigEndian.Uint32(frame[16:20])
+	payload = frame[20:]
+	ok = crc32.ChecksumIEEE(payload) == sum
+	return
+}
+
+// padToMultiple 把 bs 补 0 到 n 的整数倍，原始长度另外记在 shard frame 里，读回来再按长度截断
+func padToMultiple(bs []byte, n int) []byte {
+	rem := len(bs) % n
+	if rem == 0 {
+		return bs
+	}
+	padded := make([]byte, len(bs)+(n-rem))
+	copy(padded, bs)
+	return padded
+}
+
+// rsPendingEntry 是重组窗口里单个 seq 的状态：收集到 dataShards 个有效分片之前一直挂在这里。
+// createdAt 用来给 sweepStalePending 判断这个 seq 是不是已经等太久了(比如坏掉的分片数超过了
+// parityShards，永远凑不齐 dataShards 个有效分片)，避免 pending 无限增长
+type rsPendingEntry struct {
+	shards     [][]byte
+	origLen    uint64
+	validCount int
+	createdAt  time.Time
+}
+
+// rsQueue 是一个纠删码分片 spool，实现了和 queue.BackendQueue 一样的接口，
+// 可以直接替换 FtSender 里原来的单个 DiskQueue。写入时把数据切成 dataShards 个数据分片，
+// 编出 parityShards 个校验分片，分别落到各自路径下的 DiskQueue 里；读取时从每个分片 DiskQueue
+// 按顺序取，按 seq 分组重组，缺失或者 crc 校验失败的分片用 reed-solomon 重建出来
+type rsQueue struct {
+	name         string
+	dataShards   int
+	parityShards int
+	enc          reedsolomon.Encoder
+
+	shardQueues    []queue.BackendQueue
+	shardAvailable []bool
+
+	seq uint64 // 下一个写入批次的序列号，原子自增
+
+	readChan chan []byte
+	exitChan chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint64]*rsPendingEntry
+
+	// 下面三个字段只由 mergeLoop 这一个 goroutine 读写(reconstructAndEmit/sweepStalePending
+	// 都是在 mergeLoop 的循环体内同步调用的)，不需要加锁，用来把"凑齐 dataShards 个分片的顺序"
+	// 矫正成"seq 本来的顺序"再 emit，见 reconstructAndEmit 的注释
+	nextSeq  uint64            // 下一个应该 emit 的 seq
+	readyBuf map[uint64][]byte // 已经重建完成、但排在它前面的 seq 还没 emit 而暂存在这里的数据
+	givenUp  map[uint64]bool   // sweepStalePending 放弃重建的 seq，drain 时直接跳过，避免卡死 nextSeq
+}
+
+// newRSQueue 为 name 这个逻辑队列创建一组纠删码分片 DiskQueue，shardDirs 的长度必须正好是
+// dataShards+parityShards；某个路径创建失败时这个分片被标记为不可用，只要可用分片数不少于
+// dataShards，整体仍然可以通过重建正常工作
+func newRSQueue(name string, shardDirs []string, dataShards, parityShards int, maxBytesPerFile int64, syncEvery int64, writeLimitMB int) (*rsQueue, error) {
+	total := dataShards + parityShards
+	if len(shardDirs) != total {
+		return nil, fmt.Errorf("ft: ft_rs_paths must have exactly %d entries (ft_rs_data_shards+ft_rs_parity_shards), got %d", total, len(shardDirs))
+	}
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &rsQueue{
+		name:           name,
+		dataShards:     dataShards,
+		parityShards:   parityShards,
+		enc:            enc,
+		shardQueues:    make([]queue.BackendQueue, total),
+		shardAvailable: make([]bool, total),
+		readChan:       make(chan []byte),
+		exitChan:       make(chan struct{}),
+		pending:        make(map[uint64]*rsPendingEntry),
+		readyBuf:       make(map[uint64][]byte),
+		givenUp:        make(map[uint64]bool),
+	}
+
+	available := 0
+	for i, dir := range shardDirs {
+		if err := utils.CreateDirIfNotExist(dir); err != nil {
+			log.Errorf("%s rs shard %d path %q is not usable, will reconstruct this shard from the others: %v", name, i, dir, err)
+			continue
+		}
+		q.shardQueues[i] = queue.NewDiskQueue(fmt.Sprintf("%s_shard%d", name, i), dir, maxBytesPerFile, 0, maxBytesPerFile, syncEvery, syncEvery, time.Second*2, writeLimitMB*mb)
+		q.shardAvailable[i] = true
+		available++
+	}
+	if available < dataShards {
+		return nil, fmt.Errorf("ft: only %d/%d rs shard paths for %q are usable, need at least %d (data shards) to reconstruct", available, total, name, dataShards)
+	}
+
+	go q.mergeLoop()
+	return q, nil
+}
+
+func (q *rsQueue) Name() string {
+	return q.name
+}
+
+// Put 把 bs 切成 dataShards 个数据分片、编出 parityShards 个校验分片，各自带上 seq/crc32 写到对应的分片队列
+func (q *rsQueue) Put(bs []byte) error {
+	seq := atomic.AddUint64(&q.seq, 1) - 1
+	padded := padToMultiple(bs, q.dataShards)
+	shardSize := len(padded) / q.dataShards
+
+	shards := make([][]byte, q.dataShards+q.parityShards)
+	for i := 0; i < q.dataShards; i++ {
+		shards[i] = padded[i*shardSize : (i+1)*shardSize]
+	}
+	for i := q.dataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, shardSize)
+	}
+	if err := q.enc.Encode(shards); err != nil {
+		return err
+	}
+
+	for i, shard := range shards {
+		if !q.shardAvailable[i] {
+			continue
+		}
+		frame := encodeShardFrame(seq, uint64(len(bs)), shard)
+		if err := q.shardQueues[i].Put(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeLoop 给每个分片队列起一个 goroutine 读取，统一汇到 merged 里按 seq 重组
+func (q *rsQueue) mergeLoop() {
+	type shardFrame struct {
+		idx   int
+		seq   uint64
+		orig  uint64
+		valid bool
+		data  []byte
+	}
+	merged := make(chan shardFrame, (q.dataShards+q.parityShards)*4)
+
+	for i, sq := range q.shardQueues {
+		if sq == nil {
+			continue
+		}
+		go func(i int, sq queue.BackendQueue) {
+			ch := sq.ReadChan()
+			for {
+				select {
+				case <-q.exitChan:
+					return
+				case raw := <-ch:
+					seq, orig, payload, ok := decodeShardFrame(raw)
+					merged <- shardFrame{idx: i, seq: seq, orig: orig, valid: ok, data: payload}
+				}
+			}
+		}(i, sq)
+	}
+
+	sweepTicker := time.NewTicker(rsPendingSweepInterval)
+	defer sweepTicker.Stop()
+
+	for {
+		select {
+		case <-q.exitChan:
+			return
+		case f := <-merged:
+			q.accumulate(f.idx, f.seq, f.orig, f.valid, f.data)
+		case <-sweepTicker.C:
+			q.sweepStalePending()
+		}
+	}
+}
+
+// accumulate 记录一个分片的到达情况。重建只要求凑齐 dataShards 个*有效*分片就够了 ——
+// 不必等到当初启动时可用的所有分片都报到，这样即使某个分片队列是在运行过程中才变坏
+// (比如磁盘出现坏道)，只要其余分片还凑得够 dataShards 个，依然能正常重建并继续往下发，
+// 而不会因为永远等不到那个坏掉的分片而让这个 seq 卡死在 pending 里
+func (q *rsQueue) accumulate(idx int, seq, origLen uint64, valid bool, data []byte) {
+	// 凑齐 dataShards 个分片之后才到的剩余分片属于已经重建完成的 seq，直接丢掉，
+	// 不能再为它新开一个 pending 条目
+	if _, done := q.readyBuf[seq]; done || seq < q.nextSeq {
+		return
+	}
+	q.mu.Lock()
+	entry, ok := q.pending[seq]
+	if !ok {
+		entry = &rsPendingEntry{shards: make([][]byte, q.dataShards+q.parityShards), createdAt: time.Now()}
+		q.pending[seq] = entry
+	}
+	if valid {
+		entry.shards[idx] = data
+		entry.origLen = origLen
+		entry.validCount++
+	}
+	ready := entry.validCount >= q.dataShards
+	if ready {
+		delete(q.pending, seq)
+	}
+	q.mu.Unlock()
+
+	if ready {
+		q.reconstructAndEmit(seq, entry)
+	}
+}
+
+// sweepStalePending 清理等了超过 rsPendingTimeout 还凑不齐 dataShards 个有效分片的 seq：
+// 这种情况只可能是同时坏掉的分片数超过了 parityShards，已经没办法重建，打日志说明数据丢失，
+// 避免这些 seq 永远占着 pending 不释放
+func (q *rsQueue) sweepStalePending() {
+	q.mu.Lock()
+	var stale []uint64
+	for seq, entry := range q.pending {
+		if time.Since(entry.createdAt) >= rsPendingTimeout {
+			stale = append(stale, seq)
+		}
+	}
+	for _, seq := range stale {
+		delete(q.pending, seq)
+	}
+	q.mu.Unlock()
+
+	for _, seq := range stale {
+		log.Errorf("%s giving up on rs batch seq=%d after waiting %s, never got %d valid shards, too many shards unavailable/corrupt", q.name, seq, rsPendingTimeout, q.dataShards)
+		// 放弃的 seq 如果挡在 nextSeq 前面，会让后面已经重建好、攒在 readyBuf 里的 seq 永远
+		// emit 不出去，所以要标记成"跳过"，drainReady 遇到它直接当成已处理往后走
+		q.givenUp[seq] = true
+	}
+	if len(stale) > 0 {
+		q.drainReady()
+	}
+}
+
+// reconstructAndEmit 把 entry 对应的分片重建成完整数据。各分片队列由独立的 goroutine 并发读取、
+// 汇入 merged channel 再交给 mergeLoop 串行处理，凑齐 dataShards 个有效分片的顺序和 seq 本来的
+// 顺序没有任何关系——后写入的 seq 完全可能先凑齐。rsQueue 对外假装自己是一个 DiskQueue，调用方
+// 按写入顺序读出数据，所以这里不能重建完就直接往 readChan 塞，必须经 readyBuf 按 seq 严格排序，
+// 只有 nextSeq 及其之后连续就绪的条目才会被 emit
+func (q *rsQueue) reconstructAndEmit(seq uint64, entry *rsPendingEntry) {
+	if err := q.enc.Reconstruct(entry.shards); err != nil {
+		log.Errorf("%s cannot reconstruct rs batch seq=%d, too many shards missing/corrupt: %v", q.name, seq, err)
+		return
+	}
+	var buf bytes.Buffer
+	for i := 0; i < q.dataShards; i++ {
+		buf.Write(entry.shards[i])
+	}
+	full := buf.Bytes()
+	if uint64(len(full)) > entry.origLen {
+		full = full[:entry.origLen]
+	}
+
+	q.readyBuf[seq] = full
+	q.drainReady()
+}
+
+// drainReady 从 nextSeq 开始，把 readyBuf 里连续就绪(或者已经被 sweepStalePending 放弃)的条目
+// 依次 emit 到 readChan，直到遇到第一个既没重建完成、也没被放弃的 seq 为止
+func (q *rsQueue) drainReady() {
+	for {
+		if q.givenUp[q.nextSeq] {
+			delete(q.givenUp, q.nextSeq)
+			q.nextSeq++
+			continue
+		}
+		full, ok := q.readyBuf[q.nextSeq]
+		if !ok {
+			return
+		}
+		delete(q.readyBuf, q.nextSeq)
+		q.nextSeq++
+		select {
+		case q.readChan <- full:
+		case <-q.exitChan:
+			return
+		}
+	}
+}
+
+func (q *rsQueue) ReadChan() <-chan []byte {
+	return q.readChan
+}
+
+// Depth 取各个分片队列里最大的积压深度作为整体深度的近似值
+func (q *rsQueue) Depth() int64 {
+	var max int64
+	for _, sq := range q.shardQueues {
+		if sq == nil {
+			continue
+		}
+		if d := sq.Depth(); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+func (q *rsQueue) Close() error {
+	close(q.exitChan)
+	var firstErr error
+	for _, sq := range q.shardQueues {
+		if sq == nil {
+			continue
+		}
+		if err := sq.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// rsShardDirs 把每个 ft_rs_paths 基础路径映射成某个逻辑队列(stream/backup)自己的子目录，
+// 这样两个逻辑队列即使共用同一组 ft_rs_paths 也不会互相覆盖文件
+func rsShardDirs(basePaths []string, queueName string) []string {
+	dirs := make([]string, len(basePaths))
+	for i, p := range basePaths {
+		dirs[i] = filepath.Join(p, queueName)
+	}
+	return dirs
+}
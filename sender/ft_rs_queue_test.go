@@ -0,0 +1,130 @@
+package sender
+
+import (
+	"testing"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// newTestRSQueue 绕开 newRSQueue 里真正创建磁盘分片队列的部分，只保留重组/排序相关的状态，
+// 方便直接调用 accumulate 模拟"分片到达顺序和 seq 顺序不一致"这种只靠真正的磁盘 IO 时序
+// 很难稳定复现的场景
+func newTestRSQueue(t *testing.T, dataShards, parityShards int) *rsQueue {
+	t.Helper()
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rsQueue{
+		name:         "test",
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		enc:          enc,
+		readChan:     make(chan []byte, 8),
+		exitChan:     make(chan struct{}),
+		pending:      make(map[uint64]*rsPendingEntry),
+		readyBuf:     make(map[uint64][]byte),
+		givenUp:      make(map[uint64]bool),
+	}
+}
+
+// encodeTestShards 把 payload 按 q.dataShards 切分、编出 q.parityShards 个校验分片，
+// 返回完整的分片集合供测试直接喂给 accumulate
+func encodeTestShards(t *testing.T, q *rsQueue, payload []byte) [][]byte {
+	t.Helper()
+	padded := padToMultiple(payload, q.dataShards)
+	shardSize := len(padded) / q.dataShards
+	shards := make([][]byte, q.dataShards+q.parityShards)
+	for i := 0; i < q.dataShards; i++ {
+		shards[i] = padded[i*shardSize : (i+1)*shardSize]
+	}
+	for i := q.dataShards; i < len(shards); i++ {
+		shards[i] = make([]byte, shardSize)
+	}
+	if err := q.enc.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+// TestRSQueueEmitsInSeqOrder 覆盖 review 指出的重排序 bug：seq=1 的分片比 seq=0 的分片先
+// 凑齐 dataShards 个有效分片(模拟并发读各分片队列的 goroutine 谁先读到完全是竞态的)，
+// rsQueue 仍然必须先 emit seq=0 再 emit seq=1，不能按凑齐的顺序 emit
+func TestRSQueueEmitsInSeqOrder(t *testing.T) {
+	q := newTestRSQueue(t, 2, 1)
+
+	payload0 := []byte("seq-zero-payload")
+	payload1 := []byte("seq-one-payload-longer")
+	shards0 := encodeTestShards(t, q, payload0)
+	shards1 := encodeTestShards(t, q, payload1)
+
+	// seq=1 先凑齐 dataShards 个分片
+	for i := 0; i < q.dataShards; i++ {
+		q.accumulate(i, 1, uint64(len(payload1)), true, shards1[i])
+	}
+	select {
+	case got := <-q.readChan:
+		t.Fatalf("seq=1 must not be emitted before seq=0, got %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// seq=0 随后才凑齐
+	for i := 0; i < q.dataShards; i++ {
+		q.accumulate(i, 0, uint64(len(payload0)), true, shards0[i])
+	}
+
+	select {
+	case got := <-q.readChan:
+		if string(got) != string(payload0) {
+			t.Fatalf("want seq=0 payload %q emitted first, got %q", payload0, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for seq=0 to be emitted")
+	}
+	select {
+	case got := <-q.readChan:
+		if string(got) != string(payload1) {
+			t.Fatalf("want seq=1 payload %q emitted second, got %q", payload1, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for seq=1 to be emitted")
+	}
+}
+
+// TestRSQueueSkipsGivenUpSeq 校验 sweepStalePending 放弃一个永远凑不齐分片的 seq 之后，
+// 排在它后面、已经重建完成的 seq 不会被无限期卡住，而是照常 emit
+func TestRSQueueSkipsGivenUpSeq(t *testing.T) {
+	q := newTestRSQueue(t, 2, 1)
+
+	payload1 := []byte("seq-one-after-a-lost-seq")
+	shards1 := encodeTestShards(t, q, payload1)
+
+	// seq=0 只到了 1 个分片(不够 dataShards=2 个)，模拟另一个分片永久损坏/不可用
+	q.accumulate(0, 0, 4, true, []byte("ab"))
+
+	// seq=1 正常凑齐
+	for i := 0; i < q.dataShards; i++ {
+		q.accumulate(i, 1, uint64(len(payload1)), true, shards1[i])
+	}
+
+	// 此时 seq=1 已经重建完成但排在未就绪的 seq=0 后面，不应该被 emit
+	select {
+	case got := <-q.readChan:
+		t.Fatalf("seq=1 must wait for seq=0 to resolve, got %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// sweepStalePending 放弃 seq=0
+	q.pending[0].createdAt = time.Now().Add(-2 * rsPendingTimeout)
+	q.sweepStalePending()
+
+	select {
+	case got := <-q.readChan:
+		if string(got) != string(payload1) {
+			t.Fatalf("want seq=1 payload %q emitted once seq=0 is given up, got %q", payload1, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for seq=1 to be emitted after seq=0 was given up")
+	}
+}